@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+// benchSignature is the number of nodes for bench at benchTestDepth.
+// It must be updated when a change to the search is meant to change the node count
+const (
+	benchTestDepth = 4
+	benchSignature = 149337
+)
+
+func Test_bench(t *testing.T) {
+	tell = testTell
+	toEng, frEng := engine()
+	nodes, _ := bench(toEng, frEng, benchTestDepth)
+	if nodes != benchSignature {
+		t.Errorf("bench %v: signature should be %v but we got %v", benchTestDepth, benchSignature, nodes)
+	}
+	nodes2, _ := bench(toEng, frEng, benchTestDepth)
+	if nodes2 != nodes {
+		t.Errorf("bench %v: not reproducible. first %v nodes then %v nodes", benchTestDepth, nodes, nodes2)
+	}
+}
+
+// Test_benchSearchConfig checks that each search improvement searches fewer nodes than the search without it
+func Test_benchSearchConfig(t *testing.T) {
+	tell = testTell
+	toEng, frEng := engine()
+	defer func() { searchCfg = defaultSearchConfig }()
+	tests := []struct {
+		name  string
+		off   searchConfig // the default config with the feature turned off
+		depth int
+	}{
+		{"PVS", searchConfig{nullMove: true, lmr: true, aspiration: true, aspDelta: aspDelta}, benchTestDepth + 1},
+		{"null move", searchConfig{pvs: true, lmr: true, aspiration: true, aspDelta: aspDelta}, benchTestDepth + 1},
+		{"LMR", searchConfig{pvs: true, nullMove: true, aspiration: true, aspDelta: aspDelta}, benchTestDepth + 1},
+		// the windows only pay off from a few iterations in, so bench one more depth
+		{"aspiration", searchConfig{pvs: true, nullMove: true, lmr: true, aspDelta: aspDelta}, benchTestDepth + 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			searchCfg = tt.off
+			nodesOff, _ := bench(toEng, frEng, tt.depth)
+			searchCfg = defaultSearchConfig
+			nodesOn, _ := bench(toEng, frEng, tt.depth)
+			if nodesOn >= nodesOff {
+				t.Errorf("bench %v: %v should search fewer nodes but we got %v nodes with %v and %v nodes without", tt.depth, tt.name, nodesOn, tt.name, nodesOff)
+			}
+		})
+	}
+}
+
+func Test_benchSMP(t *testing.T) {
+	tell = testTell
+	toEng, frEng := engine()
+	clearGUI()
+	handleBench(toEng, frEng, []string{"bench", "smp", "3"})
+	wanted := []string{"info string bench threads 1 depth 3", "info string bench threads 2 depth 3", "info string bench threads 4 depth 3", "info string bench threads 8 depth 3"}
+	if want, ok := findInGUI(wanted); !ok {
+		t.Errorf("bench smp: we want %#v but we got %#v", want, guiLines())
+	}
+	if got := findOption("Threads").spin(); got != 1 {
+		t.Errorf("bench smp: Threads should be restored to 1 but it is %v", got)
+	}
+}
+
+func Test_benchKeepsBoard(t *testing.T) {
+	tell = testTell
+	toEng, frEng := engine()
+	handlePosition("position startpos moves e2e4 e7e5 g1f3")
+	fen, key, hist := board.FEN(), board.key, len(board.hist)
+	handleBench(toEng, frEng, []string{"bench", "1"})
+	if board.FEN() != fen || board.key != key || len(board.hist) != hist {
+		t.Errorf("bench should keep the board %v but we got %v", fen, board.FEN())
+	}
+}
+
+func Test_benchWhileSearching(t *testing.T) {
+	tell = testTell
+	input := make(chan string)
+	go uci(input)
+	waitForGUI(1)
+
+	input <- "position startpos"
+	clearGUI()
+	input <- "go infinite"
+	input <- "bench 1"
+	input <- "stop"
+	wanted := []string{"info string bench is not possible while the engine is searching", "bestmove"}
+	if want, ok := findInGUI(wanted); !ok {
+		t.Errorf("we want %#v but we got %#v", want, guiLines())
+	}
+	quitUci(input)
+}
+
+// the signature must not depend on the Threads and MultiPV options
+func Test_benchOptions(t *testing.T) {
+	tell = testTell
+	toEng, frEng := engine()
+	findOption("Threads").set("4")
+	findOption("MultiPV").set("3")
+	defer findOption("Threads").set("1")
+	defer findOption("MultiPV").set("1")
+
+	clearGUI()
+	handleBench(toEng, frEng, []string{"bench", strconv.Itoa(benchTestDepth)})
+	want := fmt.Sprintf("info string bench depth %v positions %v nodes %v ", benchTestDepth, len(benchFens), benchSignature)
+	if _, ok := findInGUI([]string{want}); !ok {
+		t.Errorf("we want %#v but we got %#v", want, guiLines())
+	}
+	if threads, multiPV := findOption("Threads").spin(), findOption("MultiPV").spin(); threads != 4 || multiPV != 3 {
+		t.Errorf("Threads and MultiPV should be restored to 4 and 3 but they are %v and %v", threads, multiPV)
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"strings"
 )
 
 type castlings uint
@@ -87,29 +86,33 @@ func (c castlings) String() string {
 }
 
 // parse castling rights in fenstring
-func parseCastlings(fenCastl string) castlings {
+func parseCastlings(fenCastl string) (castlings, error) {
 	c := uint(0)
 	// no castling possible
 	if fenCastl == "-" {
-		return castlings(0)
+		return castlings(0), nil
 	}
 
-	if strings.Index(fenCastl, "K") >= 0 {
-		c |= shortW
+	for _, char := range fenCastl {
+		flag := uint(0)
+		switch char {
+		case 'K':
+			flag = shortW
+		case 'Q':
+			flag = longW
+		case 'k':
+			flag = shortB
+		case 'q':
+			flag = longB
+		default:
+			return 0, fmt.Errorf("fen castling %v has an invalid character %q", fenCastl, char)
+		}
+		if c&flag != 0 {
+			return 0, fmt.Errorf("fen castling %v has %q more than once", fenCastl, char)
+		}
+		c |= flag
 	}
-
-	if strings.Index(fenCastl, "Q") >= 0 {
-		c |= longW
-	}
-
-	if strings.Index(fenCastl, "k") >= 0 {
-		c |= shortB
-	}
-
-	if strings.Index(fenCastl, "q") >= 0 {
-		c |= longB
-	}
-	return castlings(c)
+	return castlings(c), nil
 }
 
 func initCastlings() {
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,38 +14,106 @@ const (
 	maxPly   = 100
 )
 
-var cntNodes uint64
+var rootStm colour // the side to move at the root (the engine)
+var contempt int   // in centipawns. The engine avoids draws if contempt > 0
 
-//TODO search limits: count nodes and test for limit.nodes
-//TODO search limits: limit.depth
+// searchConfig turns the search improvements on and off. They are only turned off in the tests that compare node counts
+type searchConfig struct {
+	pvs        bool // Principal Variation Search
+	nullMove   bool // null move pruning
+	lmr        bool // late move reductions
+	aspiration bool // aspiration windows in root
+	aspDelta   int  // the first aspiration window is prevScore +/- aspDelta
+}
+
+var defaultSearchConfig = searchConfig{pvs: true, nullMove: true, lmr: true, aspiration: true, aspDelta: aspDelta}
+var searchCfg = defaultSearchConfig
+
+const nullVerifyDepth = 8 // null move cutoffs are verified from this depth
+
+const (
+	aspDepth = 4  // aspiration windows are used from this depth
+	aspDelta = 50 // the default searchConfig.aspDelta. The window is doubled on each fail low/high
+)
+
+const lmrMoves = 3 // the first moves are never reduced
+
+// lmrTab is the late move reduction for [depth][move number]
+var lmrTab [maxDepth][64]int
+
+func initLMR() {
+	for d := 1; d < maxDepth; d++ {
+		for m := 1; m < 64; m++ {
+			lmrTab[d][m] = int(0.5 + math.Log(float64(d))*math.Log(float64(m))/2.25)
+		}
+	}
+}
 
-//TODO search limits: time per game w/wo increments
-//TODO search limits: time per x moves and after x moves w/wo increments
 type searchLimits struct {
-	depth     int
-	nodes     uint64
-	moveTime  int // in milliseconds
-	infinite  bool
-	startTime time.Time
-	lastTime  time.Time
+	depth       int
+	nodes       uint64
+	moveTime    int // in milliseconds
+	infinite    bool
+	ponder      bool
+	mate        int      // mate in x moves
+	searchMoves []string // only search these moves
+	wTime       int      // in milliseconds. -1 if not given
+	bTime       int
+	wInc        int
+	bInc        int
+	movesToGo   int       // 0 if not given
+	startTime   time.Time // set and read only by the main thread
+	lastTime    time.Time // the last periodic info. Only the main thread
+
+	//////////////// from the time manager //////////
+	softTime int // in milliseconds. Don't start a new iteration after this time
+	hardTime int // in milliseconds. Stop the search after this time
+}
+
+var limits searchLimits    // set by the uci commands. The engine gets a copy of it for each search
+var curLimits searchLimits // the copy for the current search. Only root changes it, before the helpers start
+
+// stopFlag tells all search threads to stop. It is set by the stop command, by the main thread when a limit
+// is reached and by root when the search is done. It is read by all threads, so it is atomic
+type stopFlag int32
+
+var searchStop stopFlag
+
+func (f *stopFlag) set(st bool) {
+	v := int32(0)
+	if st {
+		v = 1
+	}
+	atomic.StoreInt32((*int32)(f), v)
+}
 
-	//////////////// current //////////
-	stop bool
+func (f *stopFlag) isSet() bool {
+	return atomic.LoadInt32((*int32)(f)) != 0
 }
 
-var limits searchLimits
+// ponderhitTime is the time (UnixNano) of the ponderhit command. It is 0 while we are pondering.
+// It is set by the uci goroutine and read by the search, so it must be accessed with atomic
+var ponderhitTime int64
+
+const noTimeLimit = 99999999999
+const noClockMoveTime = 1000 // in milliseconds. The move time when the GUI only sends the clock of the opponent
 
 func (s *searchLimits) init() {
 	s.depth = 9999
 	s.nodes = math.MaxUint64
-	s.moveTime = 99999999999
+	s.moveTime = noTimeLimit
 	s.infinite = false
-	s.stop = false
+	s.ponder = false
+	atomic.StoreInt64(&ponderhitTime, 0)
+	s.mate = 0
+	s.searchMoves = nil // the last search may still have the old slice
+	s.wTime, s.bTime = -1, -1
+	s.wInc, s.bInc = 0, 0
+	s.movesToGo = 0
+	s.softTime, s.hardTime = noTimeLimit, noTimeLimit
+	searchStop.set(false)
 }
 
-func (s *searchLimits) setStop(st bool) {
-	s.stop = st
-}
 func (s *searchLimits) setDepth(d int) {
 	s.depth = d
 }
@@ -53,6 +123,75 @@ func (s *searchLimits) setMoveTime(m int) {
 func (s *searchLimits) setInfinite(b bool) {
 	s.infinite = b
 }
+func (s *searchLimits) setPonder(b bool) {
+	s.ponder = b
+}
+
+// setTimeLimits is the time manager. It computes the soft and hard time limits for this move
+// from movetime or from the remaining time on the clock for the side to move.
+// overhead is the time in milliseconds that we lose in communication with the GUI
+func (s *searchLimits) setTimeLimits(stm colour, overhead int) {
+	s.softTime, s.hardTime = noTimeLimit, noTimeLimit
+
+	if s.moveTime != noTimeLimit {
+		s.hardTime = max(s.moveTime-overhead, 1)
+		s.softTime = s.hardTime
+		return
+	}
+
+	left, inc := s.wTime, s.wInc
+	if stm == BLACK {
+		left, inc = s.bTime, s.bInc
+	}
+	if left < 0 { // no clock for us
+		if s.wTime >= 0 || s.bTime >= 0 { // but a clock for the opponent. Don't think forever
+			s.hardTime = max(noClockMoveTime-overhead, 1)
+			s.softTime = s.hardTime
+		}
+		return
+	}
+
+	left = max(left-overhead, 1)
+	movesToGo := 30 // expected number of moves left if not given
+	if s.movesToGo > 0 {
+		movesToGo = min(s.movesToGo, 30)
+	}
+
+	s.softTime = left/movesToGo + inc*3/4
+	s.hardTime = min(s.softTime*4, left*3/4)
+	if movesToGo == 1 {
+		s.hardTime = left * 9 / 10
+	}
+	s.hardTime = max(s.hardTime, 1)
+	s.softTime = min(s.softTime, s.hardTime)
+}
+
+// pondering returns true if this is a go ponder search and the ponderhit hasn't come yet
+func (s *searchLimits) pondering() bool {
+	return s.ponder && atomic.LoadInt64(&ponderhitTime) == 0
+}
+
+// timeUp returns true if the search must stop because of the time limits.
+// After ponderhit the clock starts at the ponderhit
+func (s *searchLimits) timeUp(hard bool) bool {
+	if s.infinite || s.pondering() {
+		return false
+	}
+	start := s.startTime
+	if s.ponder {
+		start = time.Unix(0, atomic.LoadInt64(&ponderhitTime))
+	}
+	ms := int(time.Since(start).Milliseconds())
+	if hard {
+		return ms >= s.hardTime
+	}
+	return ms >= s.softTime
+}
+
+// nodesUp returns true if the search has visited the maximum number of nodes (including qs nodes)
+func (s *searchLimits) nodesUp() bool {
+	return s.nodes != math.MaxUint64 && totalNodes() >= s.nodes
+}
 
 type pvList []move
 
@@ -109,98 +248,244 @@ func (e *ebfStruct) ebf() float64 {
 	if prevNodes2 > 0.0 && prevNodes3 > 0.0 {
 		ebf = (prevNodes2/prevNodes3 + prevNodes1/prevNodes2) / 2
 	}
-	fmt.Printf("ebf: %0.2f age=%v Used=%v Stored: %v Tried: %v Found: %v Prunes: %v Best: %v\n", ebf, trans.age, trans.cntUsed, trans.cStores, trans.cTried, trans.cFound, trans.cPrune, trans.cBest)
+	fmt.Printf("ebf: %0.2f age=%v hashfull=%v Stored: %v Tried: %v Found: %v Prunes: %v Best: %v\n", ebf, trans.age, trans.hashfull(), atomic.LoadInt64(&trans.cStores), atomic.LoadInt64(&trans.cTried),
+		atomic.LoadInt64(&trans.cFound), atomic.LoadInt64(&trans.cPrune), atomic.LoadInt64(&trans.cBest))
 	return ebf
 }
 
-func engine() (toEngine chan bool, frEngine chan string) {
+// engine starts root. Each search is started by sending the limits for it on toEngine
+func engine() (toEngine chan searchLimits, frEngine chan string) {
 	frEngine = make(chan string)
-	toEngine = make(chan bool)
+	toEngine = make(chan searchLimits)
 	go root(toEngine, frEngine)
 
 	return
 }
 
-//TODO root: Aspiration search
-func root(toEngine chan bool, frEngine chan string) {
+func root(toEngine chan searchLimits, frEngine chan string) {
 	var depth, alpha, beta int
 	var ebfTab ebfStruct
 	var pv pvList
-	var childPV pvList
+	var childPV, subPV pvList
 	var ml moveList
 	childPV.new()
+	subPV.new()
 	pv.new()
 	ml.new(60)
 	ebfTab.new()
-	b := &board
-	for range toEngine {
-		limits.startTime, limits.lastTime = time.Now(), time.Now()
-		cntNodes = 0
+	var helpers sync.WaitGroup
+	for lim := range toEngine {
+		curLimits = lim
+		curLimits.startTime, curLimits.lastTime = time.Now(), time.Now()
+		rootStm = board.stm
+		contempt = findOption("Contempt").spin()
+		initThreads(findOption("Threads").spin())
+		th := threads[0] // root is the main thread
+		b := &th.b
 		ebfTab.clear()
-		killers.clear()
 		ml.clear()
 		pv.clear()
 
 		trans.initSearch() // incr age coounters=0
 
-		genAndSort(0, b, &ml)
+		genAndSort(0, th, &ml)
+		if len(ml) == 0 { // mate or stalemate. Nothing to search
+			if b.inCheck() {
+				tell("info depth 0 score mate 0")
+			} else {
+				tell("info depth 0 score cp ", strconv.Itoa(drawScore(b.stm)))
+			}
+			frEngine <- "bestmove 0000"
+			continue
+		}
+		if len(curLimits.searchMoves) > 0 { // go searchmoves
+			ml.keep(curLimits.searchMoves)
+		}
 		bm := ml[0]
 		bs := noScore
 		depth = 0
 
 		transDepth := 0
 
-		for depth = 1; depth <= limits.depth && !limits.stop; depth++ {
+		multiPV := min(findOption("MultiPV").spin(), len(ml))
+		lines := make([]pvList, multiPV) // the pv for each MultiPV line
+		mateFound, mateProven := false, false
+		doneDepth := 0    // the last depth that is completely searched
+		prevBs := noScore // the score from the last completed depth. The aspiration window is centered on it
+
+		for _, h := range threads[1:] {
+			helpers.Add(1)
+			go helper(h, curLimits.depth, &helpers)
+		}
+		for depth = 1; depth <= curLimits.depth && depth < maxDepth && !searchStop.isSet(); depth++ {
 			ml.sort()
 			bs = noScore // bm keeps the best from prev iteration in case of immediate stop before first is done in this iterastion
-			alpha, beta = minEval, maxEval
-			for ix, mv := range ml {
-				childPV.clear()
-
-				b.move(mv)
-				tell("info depth ", strconv.Itoa(depth), " currmove ", mv.String(), " currmovenumber ", strconv.Itoa(ix+1))
-				score := -search(-beta, -alpha, depth-1, 1, &childPV, b)
-
-				b.unmove(mv)
+			// with MultiPV each sub search finds the best of the moves not already found at this depth
+			for pvIx := 0; pvIx < multiPV && !searchStop.isSet(); pvIx++ {
+				// aspiration window around the score from the previous iteration (not with MultiPV)
+				delta := searchCfg.aspDelta
+				alpha, beta = minEval, maxEval
+				if searchCfg.aspiration && multiPV == 1 && depth >= aspDepth && !isMateScore(prevBs) {
+					alpha, beta = max(prevBs-delta, minEval), min(prevBs+delta, maxEval)
+				}
+				subBs, subIx := noScore, pvIx
+				for !searchStop.isSet() { // until the score is inside the window
+					alphaStart := alpha
+					subBs, subIx = noScore, pvIx
+					subPV.clear()
+					for ix := pvIx; ix < len(ml); ix++ {
+						mv := ml[ix]
+						childPV.clear()
+
+						b.move(mv)
+						tell("info depth ", strconv.Itoa(depth), " currmove ", mv.String(), " currmovenumber ", strconv.Itoa(ix+1))
+						score := noScore
+						if ix > pvIx && searchCfg.pvs {
+							score = -search(-alpha-1, -alpha, depth-1, 1, &childPV, th, true)
+							if score > alpha && score < beta { // PVS re-search
+								childPV.clear()
+								score = -search(-beta, -alpha, depth-1, 1, &childPV, th, true)
+							}
+						} else {
+							score = -search(-beta, -alpha, depth-1, 1, &childPV, th, true)
+						}
+
+						b.unmove(mv)
+
+						if curLimits.nodesUp() {
+							searchStop.set(true)
+						}
+						if searchStop.isSet() {
+							break
+						}
+						ml[ix].packEval(score)
+						if score <= alpha {
+							continue
+						}
+						subBs, subIx = score, ix
+						subPV.catenate(mv, &childPV)
+						alpha = score
+						if pvIx > 0 {
+							continue
+						}
+						bs = score
+						pv.catenate(mv, &childPV)
+
+						bm = ml[ix]
+						transDepth = depth
+						if depth >= 0 {
+							trans.store(b.fullKey(), mv, transDepth, 0, score, scoreTypeLower)
+						}
+
+						t1 := time.Since(curLimits.startTime)
+						if score >= beta && beta < maxEval { // fail high. Search again with a wider window
+							tell(fmt.Sprintf("info depth %v score %v lowerbound nodes %v time %v pv %v", depth, uciScore(beta), totalNodes(), int(t1.Seconds()*1000), pv.String()))
+							break
+						}
+						if multiPV == 1 {
+							tell(fmt.Sprintf("info score %v depth %v nodes %v time %v pv ", uciScore(bm.eval()), depth, totalNodes(), int(t1.Seconds()*1000)), pv.String())
+						}
+						if curLimits.mate > 0 && mateIn(score) > 0 && mateIn(score) <= curLimits.mate {
+							mateFound = true // go mate. We are done
+							searchStop.set(true)
+							break
+						}
+					}
+					if searchStop.isSet() {
+						break
+					}
 
-				if limits.stop {
+					delta *= 2
+					if subBs == noScore && alphaStart > minEval { // fail low
+						t1 := time.Since(curLimits.startTime)
+						tell(fmt.Sprintf("info depth %v score %v upperbound nodes %v time %v", depth, uciScore(alphaStart), totalNodes(), int(t1.Seconds()*1000)))
+						alpha = max(alphaStart-delta, minEval)
+						continue
+					}
+					if subBs >= beta && beta < maxEval { // fail high
+						alpha, beta = alphaStart, min(subBs+delta, maxEval)
+						continue
+					}
 					break
 				}
-				ml[ix].packEval(score)
-				if score > bs {
-					bs = score
-					pv.catenate(mv, &childPV)
-
-					bm = ml[ix]
-					alpha = score
-					transDepth = depth
-					if depth >= 0 {
-						trans.store(b.fullKey(), mv, transDepth, 0, score, scoreTypeLower)
-					}
 
-					t1 := time.Since(limits.startTime)
-					tell(fmt.Sprintf("info score cp %v depth %v nodes %v time %v pv ", bm.eval(), depth, cntNodes, int(t1.Seconds()*1000)), pv.String())
+				if multiPV > 1 && !searchStop.isSet() {
+					// exclude the move from the next sub search
+					ml[pvIx], ml[subIx] = ml[subIx], ml[pvIx]
+					lines[pvIx] = append(lines[pvIx][:0], subPV...)
+				}
+			}
+
+			if multiPV > 1 && !searchStop.isSet() {
+				// a later sub search may find a better score because of search instability. Sort before reporting
+				for i := 1; i < multiPV; i++ {
+					for j := i; j > 0 && ml[j].eval() > ml[j-1].eval(); j-- {
+						ml[j], ml[j-1] = ml[j-1], ml[j]
+						lines[j], lines[j-1] = lines[j-1], lines[j]
+					}
+				}
+				bm, bs = ml[0], ml[0].eval()
+				pv = append(pv[:0], lines[0]...)
+				t1 := time.Since(curLimits.startTime)
+				for i := 0; i < multiPV; i++ {
+					tell(fmt.Sprintf("info multipv %v depth %v score %v nodes %v time %v pv %v", i+1, depth, uciScore(ml[i].eval()), totalNodes(), int(t1.Seconds()*1000), lines[i].String()))
 				}
 			}
 
-			ebfTab.add(cntNodes)
+			ebfTab.add(totalNodes())
+			if !searchStop.isSet() || mateFound {
+				doneDepth = depth
+				prevBs = bs
+			}
+			if curLimits.timeUp(false) {
+				break // no time for another iteration
+			}
+			if isMateScore(bs) && mateEval-abs(bs) <= depth && !curLimits.infinite && !curLimits.pondering() {
+				mateProven = true
+				break // a deeper search will not find a shorter mate
+			}
 		}
+		searchStop.set(true) // stop the helpers. They have nothing more to add
+		helpers.Wait()
 		ml.sort()
 
-		trans.store(b.fullKey(), bm, transDepth, 0, bs, scoreType(bs, alpha, beta))
+		if bs != noScore { // not if we were stopped before the first move at this depth was searched
+			trans.store(b.fullKey(), bm, transDepth, 0, bs, scoreType(bs, alpha, beta))
+		}
 
 		// time, nps, ebf
-		t1 := time.Since(limits.startTime)
+		t1 := time.Since(curLimits.startTime)
+		nodes := totalNodes()
 		nps := float64(0)
 		if t1.Seconds() != 0 {
-			nps = float64(cntNodes) / t1.Seconds()
+			nps = float64(nodes) / t1.Seconds()
 		}
 		ebfTab.ebf()
-		tell(fmt.Sprintf("info score cp %v depth %v nodes %v  time %v nps %v pv %v", bm.eval(), depth-1, cntNodes, int(t1.Seconds()*1000), uint(nps), pv.String()))
-		frEngine <- fmt.Sprintf("bestmove %v%v", sq2Fen[bm.fr()], sq2Fen[bm.to()])
+		tell(fmt.Sprintf("info score %v depth %v nodes %v  time %v nps %v hashfull %v pv %v", uciScore(bm.eval()), doneDepth, nodes, int(t1.Seconds()*1000), uint(nps), trans.hashfull(), pv.String()))
+		if curLimits.mate > 0 && !mateFound && (depth > curLimits.depth || mateProven) { // the tree is exhausted
+			tell("info string no mate in ", strconv.Itoa(curLimits.mate), " found")
+		}
+		frEngine <- bestMove(bm, pv)
 	}
 }
 
+// bestMove returns the bestmove command to the GUI. The second move in the pv is the ponder move
+func bestMove(bm move, pv pvList) string {
+	s := "bestmove " + bm.String()
+	if len(pv) > 1 && pv[0].cmp(bm) {
+		s += " ponder " + pv[1].String()
+	}
+	return s
+}
+
+// uciScore returns the score as "cp <x>" or as "mate <y>" where y is in moves (not plies)
+func uciScore(sc int) string {
+	if isMateScore(sc) {
+		return fmt.Sprintf("mate %v", mateIn(sc))
+	}
+	return fmt.Sprintf("cp %v", sc)
+}
+
 //TODO search: hash table/transposition table
 
 //TODO search: history table and maybe counter move table
@@ -211,36 +496,61 @@ func root(toEngine chan bool, frEngine chan string) {
 //TODO search: Delta Pruning
 //TODO search: more complicated time handling schemes
 //TODO search: other reductions and extensions
-func search(alpha, beta, depth, ply int, pv *pvList, b *boardStruct) int {
-	cntNodes++
+// search is the alpha beta search. nullOk is false if null move is not allowed in this node
+func search(alpha, beta, depth, ply int, pv *pvList, th *threadStruct, nullOk bool) int {
+	b := &th.b
+	if searchStop.isSet() {
+		return alpha
+	}
+	atomic.AddUint64(&th.nodes, 1) // qs is counted here
+	// the node limit is checked before qs too. Otherwise go nodes overshoots in the leaves
+	if curLimits.nodesUp() {
+		searchStop.set(true)
+		return alpha
+	}
+	inCheck := b.inCheck()
+	if inCheck && ply < maxPly/2 {
+		depth++ // check extension
+	}
 	if depth <= 0 {
 		//return signEval(b.stm, evaluate(b))
 		return qs(beta, b)
 	}
 	pv.clear()
+	if ply >= maxPly-1 {
+		return signEval(b.stm, evaluate(b))
+	}
+
+	if b.isRepetition(ply) {
+		return drawScore(b.stm)
+	}
+	if b.rule50 >= 100 { // a mate on the 100th half move is still a mate
+		if inCheck && !b.hasLegalMove() {
+			return -mateEval + ply
+		}
+		return drawScore(b.stm)
+	}
 
 	transMove := noMove
 	transDepth := depth
 	pvNode := depth > 0 && beta != alpha+1
 
-	if depth < 0 { // inCheck?
-		transDepth = 0
-	}
-
 	{ // keep spme variables local just to be sure   - TRANS.RETRIEVE
 		var transSc, scType int
 		ok := false
 
-		if transMove, transSc, scType, ok = trans.retrieve(b.fullKey(), transDepth, ply); ok && !pvNode {
+		transMove, transSc, scType, ok = trans.retrieve(b.fullKey(), transDepth, ply)
+		transMove = b.ttMove(transMove)
+		if ok && !pvNode {
 			switch {
 			case scType == scoreTypeLower && transSc >= beta:
-				trans.cPrune++
+				trans.count(&trans.cPrune)
 				return transSc
 			case scType == scoreTypeUpper && transSc <= alpha:
-				trans.cPrune++
+				trans.count(&trans.cPrune)
 				return transSc
 			case scType == scoreTypeBetween:
-				trans.cPrune++
+				trans.count(&trans.cPrune)
 				return transSc
 			}
 		}
@@ -248,6 +558,34 @@ func search(alpha, beta, depth, ply int, pv *pvList, b *boardStruct) int {
 
 	var childPV pvList
 	childPV.new() // TODO? make it smaller for each depth maxDepth-ply
+
+	// null move pruning. Not in check, not in pv nodes, not after a null move
+	// and not with only king and pawns (zugzwang). Not in go mate, where no mate found must be a proof
+	if nullOk && searchCfg.nullMove && curLimits.mate == 0 && !pvNode && depth >= 2 && !inCheck && b.hasPieces(b.stm) {
+		if ev := signEval(b.stm, evaluate(b)); ev >= beta {
+			r := 2 + depth/6 + min((ev-beta)/200, 2) // adaptive depth reduction
+			ep := b.moveNull()
+			score := -search(-beta, -beta+1, depth-1-r, ply+1, &childPV, th, false)
+			b.unmoveNull(ep)
+			if searchStop.isSet() {
+				return alpha
+			}
+			if score >= beta {
+				if isMateScore(score) {
+					score = beta // don't trust a mate score from a null move
+				}
+				if depth < nullVerifyDepth {
+					return score
+				}
+				// verification search at high depth without null move
+				if sc := search(beta-1, beta, depth-r, ply, pv, th, false); sc >= beta {
+					return score
+				}
+			}
+		}
+	}
+	childPV.clear()
+
 	bs, score := noScore, noScore
 	bm := noMove
 
@@ -256,28 +594,60 @@ func search(alpha, beta, depth, ply int, pv *pvList, b *boardStruct) int {
 		genInOrder(b, &ml, ply, transMove)
 		for _, mv := range ml {
 	*/
-	var genInfo = genInfoStruct{sv: 0, ply: ply, transMove: transMove}
-	next = nextNormal
+	alphaOrig := alpha
+	cntMoves := 0 // legal moves
+	var genInfo = genInfoStruct{sv: 0, ply: ply, transMove: transMove, th: th}
+	var next nextFunc = nextNormal
+	if inCheck {
+		next = nextKEvasion
+	}
 	for mv, msg := next(&genInfo, b); mv != noMove; mv, msg = next(&genInfo, b) {
-		_ = msg
-
 		if !b.move(mv) {
 			continue
 		}
+		cntMoves++
 
 		childPV.clear()
 
-		/* 	if pvNode && bm != noMove {
-			score =  -search(-alpha-1, -alpha, depth-1, ply+1, &childPV, b)
-			if score > alpha { // PVS/LMR re-search
-				score = -search(-beta, -alpha, depth-1, ply+1, &childPV, b)
+		// late move reduction of quiet moves that don't give check. Not killers, captures or promotions.
+		// Not in go mate
+		reduction := 0
+		if searchCfg.lmr && curLimits.mate == 0 && depth >= 3 && cntMoves > lmrMoves && !inCheck && (msg == "first non capt" || msg == "non Capt") && !b.inCheck() {
+			reduction = lmrTab[min(depth, maxDepth-1)][min(cntMoves, 63)]
+			if h := th.history.get(mv.fr(), mv.to(), b.stm.opp()); h > uint(depth*depth) {
+				reduction-- // the move has been good before
+			} else if h == 0 {
+				reduction++
+			}
+			if pvNode {
+				reduction--
+			}
+			reduction = max(min(reduction, depth-2), 0)
+		}
+
+		if reduction > 0 {
+			score = -search(-alpha-1, -alpha, depth-1-reduction, ply+1, &childPV, th, true)
+			if score > alpha { // LMR re-search at full depth
+				reduction = 0
+				childPV.clear()
 			}
-		} else {
-		*/
-		score = -search(-beta, -alpha, depth-1, ply+1, &childPV, b)
-		//		}
+		}
+		if reduction == 0 {
+			if pvNode && cntMoves > 1 && searchCfg.pvs {
+				score = -search(-alpha-1, -alpha, depth-1, ply+1, &childPV, th, true)
+				if score > alpha && score < beta { // PVS re-search
+					childPV.clear()
+					score = -search(-beta, -alpha, depth-1, ply+1, &childPV, th, true)
+				}
+			} else {
+				score = -search(-beta, -alpha, depth-1, ply+1, &childPV, th, true)
+			}
+		}
 
 		b.unmove(mv)
+		if searchStop.isSet() {
+			return alpha // the score of an aborted child is not valid. Don't store it or update killers and history
+		}
 
 		if score > bs {
 			bs = score
@@ -285,49 +655,57 @@ func search(alpha, beta, depth, ply int, pv *pvList, b *boardStruct) int {
 			pv.catenate(mv, &childPV)
 			if score > alpha {
 				alpha = score
-				trans.store(b.fullKey(), mv, depth, ply, score, scoreType(score, alpha, beta))
 			}
 
 			if score >= beta { // beta cutoff
+				trans.store(b.fullKey(), mv, depth, ply, score, scoreTypeLower)
 				// add killer and update history
 				if mv.cp() == empty && mv.pr() == empty {
-					killers.add(mv, ply)
+					th.killers.add(mv, ply)
 				}
 				if mv.cmp(transMove) {
-					trans.cPrune++
+					trans.count(&trans.cPrune)
 				}
-				history.inc(mv.fr(), mv.to(), b.stm, depth)
+				th.history.inc(mv.fr(), mv.to(), b.stm, depth)
 				return score
 			}
 		}
 
-		tStep := time.Since(limits.lastTime) - time.Duration(time.Millisecond*200)
-		if tStep >= 0 {
-			limits.lastTime = time.Now().Add(-time.Duration(tStep))
-			t1 := time.Since(limits.startTime)
-			ms := uint64(t1.Nanoseconds() / 1000000)
-			if t1.Seconds() > 1 {
-				if ms%1000 <= 5 {
-					tell(fmt.Sprintf("info time %v nodes %v nps %v", ms, cntNodes, cntNodes/uint64(t1.Seconds())))
-				}
+		if th.id == 0 { // the time is kept by the main thread only
+			if time.Since(curLimits.lastTime) >= time.Second {
+				curLimits.lastTime = time.Now()
+				t1 := time.Since(curLimits.startTime)
+				nodes := totalNodes()
+				tell(fmt.Sprintf("info time %v nodes %v nps %v hashfull %v", t1.Milliseconds(), nodes, uint64(float64(nodes)/t1.Seconds()), trans.hashfull()))
 			}
-
-			if ms >= uint64(limits.moveTime)-200 {
-				//				fmt.Println("t1", uint64(t1.Nanoseconds()/1000000)-100, "limit", uint64(limits.moveTime))
-				limits.stop = true
+			if curLimits.timeUp(true) {
+				searchStop.set(true)
+				return alpha
 			}
 		}
-
-		if limits.stop {
-			return alpha
+	}
+	if cntMoves == 0 { // no legal moves
+		if inCheck {
+			return -mateEval + ply // mated
 		}
+		return drawScore(b.stm) // stalemate
 	}
+
+	trans.store(b.fullKey(), bm, depth, ply, bs, scoreType(bs, alphaOrig, beta))
 	if bm.cmp(transMove) {
-		trans.cBest++
+		trans.count(&trans.cBest)
 	}
 	return bs
 }
 
+// drawScore returns the score of a draw for stm. With contempt > 0 the engine sees a draw as a small loss
+func drawScore(stm colour) int {
+	if stm == rootStm {
+		return -contempt
+	}
+	return contempt
+}
+
 func initQS(ml *moveList, b *boardStruct) {
 	ml.clear()
 	b.genAllCaptures(ml)
@@ -486,7 +864,8 @@ func see(fr, to int, b *boardStruct) int {
 
 	ml.sort()
 } */
-func genAndSort(ply int, b *boardStruct, ml *moveList) {
+func genAndSort(ply int, th *threadStruct, ml *moveList) {
+	b := &th.b
 	if ply > maxPly {
 		panic("wtf maxply")
 	}
@@ -498,9 +877,9 @@ func genAndSort(ply int, b *boardStruct, ml *moveList) {
 		b.move(mv)
 		v := evaluate(b)
 		b.unmove(mv)
-		if killers[ply].k1.cmp(mv) {
+		if th.killers[ply].k1.cmp(mv) {
 			v += 1000
-		} else if killers[ply].k2.cmp(mv) {
+		} else if th.killers[ply].k2.cmp(mv) {
 			v += 900
 		}
 
@@ -513,7 +892,8 @@ func genAndSort(ply int, b *boardStruct, ml *moveList) {
 }
 
 // generate capture moves first, then killers, then non captures
-func genInOrder(b *boardStruct, ml *moveList, ply int, transMove move) {
+func genInOrder(th *threadStruct, ml *moveList, ply int, transMove move) {
+	b := &th.b
 	ml.clear()
 	b.genAllCaptures(ml)
 	noCaptIx := len(*ml)
@@ -540,12 +920,12 @@ func genInOrder(b *boardStruct, ml *moveList, ply int, transMove move) {
 		for ix := noCaptIx; ix < len(*ml); ix++ {
 			mv := (*ml)[ix]
 			switch {
-			case killers[ply].k1.cmpFrTo(mv) && !mv.cmpFrTo(transMove) && b.sq[mv.to()] == empty:
+			case th.killers[ply].k1.cmpFrTo(mv) && !mv.cmpFrTo(transMove) && b.sq[mv.to()] == empty:
 				mv.packMove(mv.fr(), mv.to(), b.sq[mv.fr()], b.sq[mv.to()], mv.pr(), b.ep, b.castlings)
 				(*ml)[ix] = mv
 				(*ml)[ix], (*ml)[pos1] = (*ml)[pos1], (*ml)[ix]
 				cnt++
-			case killers[ply].k2.cmpFrTo(mv) && !mv.cmpFrTo(transMove) && b.sq[mv.to()] == empty:
+			case th.killers[ply].k2.cmpFrTo(mv) && !mv.cmpFrTo(transMove) && b.sq[mv.to()] == empty:
 				mv.packMove(mv.fr(), mv.to(), b.sq[mv.fr()], b.sq[mv.to()], mv.pr(), b.ep, b.castlings)
 				(*ml)[ix] = mv
 				(*ml)[ix], (*ml)[pos2] = (*ml)[pos2], (*ml)[ix]
@@ -588,8 +968,6 @@ func (k *killerStruct) add(mv move, ply int) {
 	}
 }
 
-var killers killerStruct
-
 ///////////////////////////// history table //////////////////////////////////
 type historyStruct [2][64][64]uint
 
@@ -651,10 +1029,55 @@ func (h historyStruct) Print(n int) {
 	}
 }
 
-var history historyStruct
+/////////////////////////// Threads (Lazy SMP) /////////////////////////////
+// threadStruct is what each search thread owns. The transposition table and the stop flag are shared
+type threadStruct struct {
+	nodes   uint64 // nodes searched (including qs nodes). First in the struct to be 64-bit aligned for atomic
+	id      int    // 0 is the main thread that runs root
+	b       boardStruct
+	killers killerStruct
+	history historyStruct
+}
+
+var threads []*threadStruct
+
+// initThreads prepares n search threads with a copy of the board each
+func initThreads(n int) {
+	for len(threads) < n {
+		threads = append(threads, &threadStruct{id: len(threads)})
+	}
+	threads = threads[:n]
+	for _, th := range threads {
+		atomic.StoreUint64(&th.nodes, 0)
+		th.b = board.copy()
+		th.killers.clear()
+		th.history.clear()
+	}
+}
+
+// totalNodes returns the nodes searched by all threads
+func totalNodes() uint64 {
+	nodes := uint64(0)
+	for _, th := range threads {
+		nodes += atomic.LoadUint64(&th.nodes)
+	}
+	return nodes
+}
+
+// helper is a Lazy SMP helper thread. It searches the root position with iterative deepening
+// and shares what it finds with the main thread through the transposition table.
+// Every other helper starts one depth deeper so that the threads are not searching the same depth
+func helper(th *threadStruct, maxD int, wg *sync.WaitGroup) {
+	defer wg.Done()
+	var pv pvList
+	pv.new()
+	for depth := 1 + th.id%2; depth <= maxD && depth < maxDepth && !searchStop.isSet(); depth++ {
+		search(minEval, maxEval, depth, 0, &pv, th, false)
+	}
+}
 
 /////////////////////////// Next move /////////////////////////////////////
-var next func(*genInfoStruct, *boardStruct) (move, string) // or nextKEvasion or nextQS
+type nextFunc func(*genInfoStruct, *boardStruct) (move, string) // nextNormal or nextKEvasion or nextQS
 
 const (
 	initNext = iota
@@ -667,6 +1090,7 @@ const (
 	nextFirstNonCp
 	nextNonCp
 	nextBadCp
+	nextEvasion
 	nextEnd
 )
 
@@ -674,6 +1098,7 @@ type genInfoStruct struct {
 	// to be filled in, before first call to the next-function
 	sv, ply   int
 	transMove move
+	th        *threadStruct // killers and history
 
 	// handle by the next-function
 	captures, nonCapt moveList
@@ -747,10 +1172,10 @@ func nextNormal(genInfo *genInfoStruct, b *boardStruct) (move, string) {
 		fallthrough
 	case nextK1: // not transMove
 		genInfo.sv = nextK2
-		if killers[genInfo.ply].k1 != noMove && !genInfo.transMove.cmpFrTo(killers[genInfo.ply].k1) {
-			if b.isLegal(killers[genInfo.ply].k1) {
+		if genInfo.th.killers[genInfo.ply].k1 != noMove && !genInfo.transMove.cmpFrTo(genInfo.th.killers[genInfo.ply].k1) {
+			if b.isLegal(genInfo.th.killers[genInfo.ply].k1) {
 				var mv move
-				mv.packMove(killers[genInfo.ply].k1.fr(), killers[genInfo.ply].k1.to(), b.sq[killers[genInfo.ply].k1.fr()], b.sq[killers[genInfo.ply].k1.to()], killers[genInfo.ply].k1.pr(), b.ep, b.castlings)
+				mv.packMove(genInfo.th.killers[genInfo.ply].k1.fr(), genInfo.th.killers[genInfo.ply].k1.to(), b.sq[genInfo.th.killers[genInfo.ply].k1.fr()], b.sq[genInfo.th.killers[genInfo.ply].k1.to()], genInfo.th.killers[genInfo.ply].k1.pr(), b.ep, b.castlings)
 				return mv, "K1"
 			}
 		}
@@ -758,10 +1183,10 @@ func nextNormal(genInfo *genInfoStruct, b *boardStruct) (move, string) {
 		fallthrough
 	case nextK2: // not transMove
 		genInfo.sv = nextCounterMv
-		if killers[genInfo.ply].k2 != noMove && !genInfo.transMove.cmpFrTo(killers[genInfo.ply].k2) {
-			if b.isLegal(killers[genInfo.ply].k2) {
+		if genInfo.th.killers[genInfo.ply].k2 != noMove && !genInfo.transMove.cmpFrTo(genInfo.th.killers[genInfo.ply].k2) {
+			if b.isLegal(genInfo.th.killers[genInfo.ply].k2) {
 				var mv move
-				mv.packMove(killers[genInfo.ply].k2.fr(), killers[genInfo.ply].k2.to(), b.sq[killers[genInfo.ply].k2.fr()], b.sq[killers[genInfo.ply].k2.to()], killers[genInfo.ply].k2.pr(), b.ep, b.castlings)
+				mv.packMove(genInfo.th.killers[genInfo.ply].k2.fr(), genInfo.th.killers[genInfo.ply].k2.to(), b.sq[genInfo.th.killers[genInfo.ply].k2.fr()], b.sq[genInfo.th.killers[genInfo.ply].k2.to()], genInfo.th.killers[genInfo.ply].k2.pr(), b.ep, b.castlings)
 				return mv, "K2"
 			}
 		}
@@ -786,10 +1211,10 @@ func nextNormal(genInfo *genInfoStruct, b *boardStruct) (move, string) {
 		bs := minEval
 		bIx := -1
 		for ix := 0; ix < len(*ml); ix++ {
-			if (*ml)[ix].cmp(genInfo.transMove) || (*ml)[ix].cmp(genInfo.counterMv) || (*ml)[ix].cmp(killers[genInfo.ply].k1) || (*ml)[ix].cmp(killers[genInfo.ply].k2) {
+			if (*ml)[ix].cmp(genInfo.transMove) || (*ml)[ix].cmp(genInfo.counterMv) || (*ml)[ix].cmp(genInfo.th.killers[genInfo.ply].k1) || (*ml)[ix].cmp(genInfo.th.killers[genInfo.ply].k2) {
 				continue
 			}
-			sc := int(history.get((*ml)[ix].fr(), (*ml)[ix].to(), b.stm))
+			sc := int(genInfo.th.history.get((*ml)[ix].fr(), (*ml)[ix].to(), b.stm))
 			if sc > bs {
 				bs = sc
 				bIx = ix
@@ -814,10 +1239,10 @@ func nextNormal(genInfo *genInfoStruct, b *boardStruct) (move, string) {
 		bIx := -1
 		ml := &genInfo.nonCapt
 		for ix := 0; ix < len(*ml); ix++ {
-			if (*ml)[ix].cmp(genInfo.transMove) || (*ml)[ix].cmp(genInfo.counterMv) || (*ml)[ix].cmp(killers[genInfo.ply].k1) || (*ml)[ix].cmp(killers[genInfo.ply].k2) {
+			if (*ml)[ix].cmp(genInfo.transMove) || (*ml)[ix].cmp(genInfo.counterMv) || (*ml)[ix].cmp(genInfo.th.killers[genInfo.ply].k1) || (*ml)[ix].cmp(genInfo.th.killers[genInfo.ply].k2) {
 				continue
 			}
-			sc := int(history.get((*ml)[ix].fr(), (*ml)[ix].to(), b.stm))
+			sc := int(genInfo.th.history.get((*ml)[ix].fr(), (*ml)[ix].to(), b.stm))
 			if sc > bs {
 				bs = sc
 				bIx = ix
@@ -853,3 +1278,45 @@ func nextNormal(genInfo *genInfoStruct, b *boardStruct) (move, string) {
 		panic("neve come here! nextNormal sv=" + strconv.Itoa(genInfo.sv))
 	}
 }
+
+// nextKEvasion gives the moves out of check from genEvasions. They are picked best first:
+// transMove, captures by see, killers and quiet moves by history
+func nextKEvasion(genInfo *genInfoStruct, b *boardStruct) (move, string) {
+	ml := &genInfo.captures
+	if genInfo.sv == initNext {
+		genInfo.sv = nextEvasion
+		ml.new(20)
+		b.genEvasions(ml)
+		kill := genInfo.th.killers[genInfo.ply]
+		for ix := range *ml {
+			mv := (*ml)[ix]
+			sc := 0
+			switch {
+			case mv.cmp(genInfo.transMove):
+				sc = 30000
+			case mv.cp() != empty || mv.pr() != empty:
+				sc = 20000 + see(mv.fr(), mv.to(), b)
+			case mv.cmp(kill.k1) || mv.cmp(kill.k2):
+				sc = 15000
+			default:
+				sc = min(int(genInfo.th.history.get(mv.fr(), mv.to(), b.stm)), 10000)
+			}
+			(*ml)[ix].packEval(sc)
+		}
+	}
+
+	if len(*ml) == 0 {
+		genInfo.sv = nextEnd
+		return noMove, ""
+	}
+	bIx := 0
+	for ix := 1; ix < len(*ml); ix++ {
+		if (*ml)[ix].eval() > (*ml)[bIx].eval() {
+			bIx = ix
+		}
+	}
+	mv := (*ml)[bIx]
+	(*ml)[bIx], (*ml)[len(*ml)-1] = (*ml)[len(*ml)-1], (*ml)[bIx]
+	*ml = (*ml)[:len(*ml)-1]
+	return mv, "evasion"
+}
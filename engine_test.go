@@ -0,0 +1,469 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_setTimeLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		cmd      []string
+		stm      colour
+		overhead int
+		soft     int
+		hard     int
+	}{
+		{"movetime", []string{"movetime", "1000"}, WHITE, 50, 950, 950},
+		{"no clock", []string{"depth", "5"}, WHITE, 50, noTimeLimit, noTimeLimit},
+		{"no clock for black", []string{"wtime", "60000"}, BLACK, 50, 950, 950},
+		{"no clock for white", []string{"btime", "60000", "binc", "1000"}, WHITE, 50, 950, 950},
+		{"wtime", []string{"wtime", "60050", "btime", "1000"}, WHITE, 50, 2000, 8000},
+		{"btime binc", []string{"wtime", "1000", "btime", "30050", "winc", "0", "binc", "1000"}, BLACK, 50, 1750, 7000},
+		{"movestogo", []string{"wtime", "10050", "movestogo", "10"}, WHITE, 50, 1000, 4000},
+		{"last move", []string{"wtime", "10050", "movestogo", "1"}, WHITE, 50, 9000, 9000},
+		{"low on time", []string{"wtime", "450", "winc", "1000"}, WHITE, 50, 300, 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limits.init()
+			for ix := 0; ix < len(tt.cmd); ix += 2 {
+				v, _ := strconv.Atoi(tt.cmd[ix+1])
+				switch tt.cmd[ix] {
+				case "movetime":
+					limits.setMoveTime(v)
+				case "wtime":
+					limits.wTime = v
+				case "btime":
+					limits.bTime = v
+				case "winc":
+					limits.wInc = v
+				case "binc":
+					limits.bInc = v
+				case "movestogo":
+					limits.movesToGo = v
+				case "depth":
+					limits.setDepth(v)
+				}
+			}
+			limits.setTimeLimits(tt.stm, tt.overhead)
+			if limits.softTime != tt.soft || limits.hardTime != tt.hard {
+				t.Errorf("%v: soft/hard should be %v/%v but we got %v/%v", tt.name, tt.soft, tt.hard, limits.softTime, limits.hardTime)
+			}
+		})
+	}
+}
+
+func Test_mate(t *testing.T) {
+	tell = testTell
+	toEng, frEng := engine()
+	tests := []struct {
+		name  string
+		pos   string
+		depth int
+		bm    string
+		score string
+	}{
+		{"mate in 1 W", "position fen 6k1/5ppp/8/8/8/8/8/R5K1 w - - 0 1", 3, "bestmove a1a8", "score mate 1 "},
+		{"mate in 1 B", "position fen r5k1/5ppp/8/8/8/8/5PPP/6K1 b - - 0 1", 3, "bestmove a8a1", "score mate 1 "},
+		{"mate in 2", "position fen 7k/8/8/8/8/8/R7/1R4K1 w - - 0 1", 4, "", "score mate 2 "},
+		{"mated in 1", "position fen 6k1/5ppp/8/8/8/1r6/r7/7K w - - 0 1", 3, "", "score mate -1 "},
+		{"mated", "position fen 6k1/5ppp/8/8/8/8/6PP/r6K w - - 0 1", 3, "bestmove 0000", "score mate 0"},
+		{"stalemate", "position fen k7/8/1Q6/8/8/8/8/7K b - - 0 1", 3, "bestmove 0000", "score cp 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearGUI()
+			handlePosition(tt.pos)
+			limits.init()
+			limits.setDepth(tt.depth)
+			toEng <- limits
+			bm := <-frEng
+			if tt.bm != "" && bm != tt.bm {
+				t.Errorf("%v: should be %#v but we got %#v", tt.name, tt.bm, bm)
+			}
+			found := false
+			for _, line := range guiLines() {
+				if strings.Contains(line, tt.score) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%v: %#v not found in %#v", tt.name, tt.score, guiLines())
+			}
+		})
+	}
+}
+
+func Test_searchNoMoves(t *testing.T) {
+	tests := []struct {
+		name string
+		pos  string
+		want int
+	}{
+		{"mated", "position fen 6k1/5ppp/8/8/8/8/6PP/r6K w - - 0 1", -mateEval + 1},
+		{"stalemate", "position fen k7/8/1Q6/8/8/8/8/7K b - - 0 1", 0},
+		{"mated at the 50 move limit", "position fen 6k1/5ppp/8/8/8/8/6PP/r6K w - - 100 80", -mateEval + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var pv pvList
+			pv.new()
+			handlePosition(tt.pos)
+			trans.clear()
+			limits.init()
+			curLimits = limits
+			initThreads(1)
+			if got := search(minEval, maxEval, 2, 1, &pv, threads[0], true); got != tt.want {
+				t.Errorf("%v: search should return %v but we got %v", tt.name, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_draws(t *testing.T) {
+	tell = testTell
+	toEng, frEng := engine()
+	tests := []struct {
+		name     string
+		pos      string
+		contempt string
+		score    string
+	}{
+		{"50 move rule", "position fen 7k/8/8/8/8/8/8/R6K w - - 99 80", "0", "score cp 0 depth 3"},
+		{"50 move rule contempt", "position fen 7k/8/8/8/8/8/8/R6K w - - 99 80", "20", "score cp -20 depth 3"},
+		{"50 move rule contempt B", "position fen r6k/8/8/8/8/8/8/7K b - - 99 80", "-30", "score cp 30 depth 3"},
+		{"mate on the 100th half move", "position fen 7k/6pp/8/8/8/8/8/R6K w - - 99 80", "0", "score mate 1 depth 1"},
+	}
+	defer findOption("Contempt").set("0")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearGUI()
+			findOption("Contempt").set(tt.contempt)
+			handlePosition(tt.pos)
+			limits.init()
+			limits.setDepth(3)
+			toEng <- limits
+			<-frEng
+			found := false
+			for _, line := range guiLines() {
+				if strings.Contains(line, tt.score) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%v: %#v not found in %#v", tt.name, tt.score, guiLines())
+			}
+		})
+	}
+}
+
+func Test_nodesLimit(t *testing.T) {
+	tell = testTell
+	toEng, frEng := engine()
+	tests := []struct {
+		name  string
+		pos   string
+		nodes uint64
+	}{
+		{"startpos", "position startpos", 5000},
+		{"kiwipete", "position fen r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1", 20000},
+		{"endgame", "position fen 8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1", 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var bms [2]string
+			var cnts [2]uint64
+			for i := range bms {
+				handlePosition(tt.pos)
+				trans.clear()
+				limits.init()
+				limits.nodes = tt.nodes
+				toEng <- limits
+				bms[i] = <-frEng
+				cnts[i] = totalNodes()
+			}
+			if bms[0] != bms[1] || cnts[0] != cnts[1] {
+				t.Errorf("%v: not reproducible. %v/%v nodes and %v/%v", tt.name, cnts[0], cnts[1], bms[0], bms[1])
+			}
+			if cnts[0] != tt.nodes {
+				t.Errorf("%v: searched %v nodes but the limit is %v", tt.name, cnts[0], tt.nodes)
+			}
+		})
+	}
+}
+
+func Test_bestMove(t *testing.T) {
+	var e2e4, e7e5, e7e8, b2a1 move
+	e2e4.packMove(E2, E4, wP, empty, empty, 0, 0)
+	e7e5.packMove(E7, E5, bP, empty, empty, 0, 0)
+	e7e8.packMove(E7, E8, wP, empty, wQ, 0, 0)
+	b2a1.packMove(B2, A1, bP, wR, bN, 0, 0)
+	tests := []struct {
+		name string
+		bm   move
+		pv   pvList
+		want string
+	}{
+		{"no pv", e2e4, pvList{}, "bestmove e2e4"},
+		{"ponder", e2e4, pvList{e2e4, e7e5}, "bestmove e2e4 ponder e7e5"},
+		{"pv not bm", e7e5, pvList{e2e4, e7e5}, "bestmove e7e5"},
+		{"white promotion", e7e8, pvList{e7e8}, "bestmove e7e8q"},
+		{"black promotion", b2a1, pvList{e2e4, b2a1}, "bestmove b2a1n"},
+		{"ponder promotion", e2e4, pvList{e2e4, b2a1}, "bestmove e2e4 ponder b2a1n"},
+		{"no move", noMove, pvList{}, "bestmove 0000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := bestMove(tt.bm, tt.pv); got != tt.want {
+				t.Errorf("%v: should be %#v but we got %#v", tt.name, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_bestMovePromotion(t *testing.T) {
+	tell = testTell
+	toEng, frEng := engine()
+	tests := []struct {
+		name string
+		pos  string
+		bm   string
+	}{
+		{"white queen", "position fen 7k/4P3/8/8/8/8/8/K7 w - - 0 1", "bestmove e7e8q"},
+		{"black queen", "position fen 7k/8/8/8/8/8/4p3/2K5 b - - 0 1", "bestmove e2e1q"},
+		{"black knight fork", "position fen 8/8/8/8/8/5Q2/k3p1K1/8 b - - 0 1", "bestmove e2e1n ponder"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlePosition(tt.pos)
+			limits.init()
+			limits.setDepth(4)
+			toEng <- limits
+			if bm := <-frEng; !strings.HasPrefix(bm, tt.bm) {
+				t.Errorf("%v: should start with %#v but we got %#v", tt.name, tt.bm, bm)
+			}
+		})
+	}
+}
+
+func Test_multiPV(t *testing.T) {
+	tell = testTell
+	toEng, frEng := engine()
+	tests := []struct {
+		name    string
+		pos     string
+		multiPV string
+		depth   int
+		lines   int // number of multipv lines at the last depth
+	}{
+		{"startpos 3", "position startpos", "3", 3, 3},
+		{"kiwipete 5", "position fen r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1", "5", 2, 5},
+		{"only 2 moves", "position fen 7k/8/8/8/8/8/r7/6K1 w - - 0 1", "4", 2, 2},
+		{"multipv 1", "position startpos", "1", 2, 0},
+	}
+	defer findOption("MultiPV").set("1")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearGUI()
+			findOption("MultiPV").set(tt.multiPV)
+			handlePosition(tt.pos)
+			limits.init()
+			limits.setDepth(tt.depth)
+			toEng <- limits
+			<-frEng
+			prefix := "info multipv "
+			firstMoves := map[string]bool{}
+			lastIx, lastScore := 0, 0
+			for _, line := range guiLines() {
+				if !strings.HasPrefix(line, prefix) || !strings.Contains(line, " depth "+strconv.Itoa(tt.depth)+" ") {
+					continue
+				}
+				words := strings.Fields(line)
+				ix, _ := strconv.Atoi(words[2])
+				if ix != lastIx+1 {
+					t.Errorf("%v: multipv %v should be %v in %#v", tt.name, ix, lastIx+1, line)
+				}
+				score, _ := strconv.Atoi(words[7])
+				if ix > 1 && score > lastScore {
+					t.Errorf("%v: multipv %v has a better score than multipv %v: %#v", tt.name, ix, lastIx, line)
+				}
+				lastIx, lastScore = ix, score
+				pvIx := strings.Index(line, " pv ")
+				mv := strings.Fields(line[pvIx+4:])[0]
+				if firstMoves[mv] {
+					t.Errorf("%v: %v is already found in another multipv line %#v", tt.name, mv, line)
+				}
+				firstMoves[mv] = true
+			}
+			if lastIx != tt.lines {
+				t.Errorf("%v: should have %v multipv lines but we got %v", tt.name, tt.lines, lastIx)
+			}
+		})
+	}
+}
+
+// Test_aspiration searches the bench positions to aspDepth with the window prevScore +/- 1, where
+// prevScore is the score from aspDepth-1. The first bound must be the edge of that window and the
+// re-search must end with an exact score outside it. Both fail high and fail low must be seen
+func Test_aspiration(t *testing.T) {
+	tell = testTell
+	toEng, frEng := engine()
+	defer func() { searchCfg = defaultSearchConfig }()
+	searchCfg.aspDelta = 1
+
+	// score returns the score in "cp x" or "mate x". Mate scores are outside every window
+	score := func(f []string) int {
+		v, _ := strconv.Atoi(f[1])
+		if f[0] == "mate" {
+			if v > 0 {
+				return maxEval
+			}
+			return minEval
+		}
+		return v
+	}
+	prevDepth, depth := " depth "+strconv.Itoa(aspDepth-1)+" ", " depth "+strconv.Itoa(aspDepth)+" "
+	fails := map[string]int{}
+	for _, fen := range benchFens {
+		clearGUI()
+		handlePosition("position fen " + fen)
+		trans.clear()
+		limits.init()
+		limits.setDepth(aspDepth)
+		toEng <- limits
+		<-frEng
+
+		var prev, last, bound []string
+		for _, line := range guiLines() {
+			f := strings.Fields(line)
+			switch {
+			case strings.HasPrefix(line, "info score ") && strings.Contains(line, prevDepth):
+				prev = f[2:4]
+			case strings.HasPrefix(line, "info score ") && strings.Contains(line, depth):
+				last = f[2:4]
+			case bound == nil && strings.HasPrefix(line, "info depth ") && strings.Contains(line, "bound "):
+				bound = f[4:7]
+			}
+		}
+		if prev == nil || last == nil {
+			t.Fatalf("%v: no exact score at depth %v and %v. We got %#v", fen, aspDepth-1, aspDepth, guiLines())
+		}
+		if prev[0] == "mate" || bound == nil { // no window or the score didn't change
+			continue
+		}
+		prevSc, lastSc := score(prev), score(last)
+		switch bound[2] {
+		case "lowerbound":
+			if score(bound) != prevSc+1 || lastSc < prevSc+1 {
+				t.Errorf("%v: the window is %v +/- 1. We got %v and then the score %v", fen, prevSc, bound, lastSc)
+			}
+		case "upperbound":
+			if score(bound) != prevSc-1 || lastSc > prevSc-1 {
+				t.Errorf("%v: the window is %v +/- 1. We got %v and then the score %v", fen, prevSc, bound, lastSc)
+			}
+		}
+		fails[bound[2]]++
+	}
+	if fails["lowerbound"] == 0 || fails["upperbound"] == 0 {
+		t.Errorf("both fail high and fail low should be seen. We got %v", fails)
+	}
+}
+
+func Test_threads(t *testing.T) {
+	tell = testTell
+	toEng, frEng := engine()
+	tests := []struct {
+		name    string
+		pos     string
+		threads string
+		depth   int
+	}{
+		{"startpos 1", "position startpos", "1", 5},
+		{"startpos 4", "position startpos", "4", 5},
+		{"kiwipete 3", "position fen r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1", "3", 4},
+		{"mate in 2 8", "position fen 7k/8/8/8/8/8/R7/1R4K1 w - - 0 1", "8", 4},
+	}
+	defer findOption("Threads").set("1")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			findOption("Threads").set(tt.threads)
+			handlePosition(tt.pos)
+			fen := board.FEN()
+			trans.clear()
+			limits.init()
+			limits.setDepth(tt.depth)
+			toEng <- limits
+			bm := strings.Fields(<-frEng)[1]
+
+			var ml moveList
+			board.genAllLegals(&ml)
+			legal := false
+			for _, mv := range ml {
+				if mv.String() == bm {
+					legal = true
+				}
+			}
+			if !legal {
+				t.Errorf("%v: bestmove %v is not legal", tt.name, bm)
+			}
+			if board.FEN() != fen {
+				t.Errorf("%v: the board is changed by the search. %v should be %v", tt.name, board.FEN(), fen)
+			}
+			if len(threads) != findOption("Threads").spin() {
+				t.Errorf("%v: searched with %v threads but Threads is %v", tt.name, len(threads), tt.threads)
+			}
+			sum := uint64(0)
+			for _, th := range threads {
+				sum += th.nodes
+			}
+			if sum == 0 || sum != totalNodes() {
+				t.Errorf("%v: total nodes %v should be the sum of the threads %v", tt.name, totalNodes(), sum)
+			}
+		})
+	}
+}
+
+// Test_stoppedSearch checks that a node that is stopped doesn't store the aborted score or update the killers
+func Test_stoppedSearch(t *testing.T) {
+	defer limits.init()
+	for nodes := uint64(2); nodes < 40; nodes++ {
+		handlePosition("position fen r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1")
+		trans.clear()
+		limits.init()
+		limits.nodes = nodes
+		curLimits = limits
+		initThreads(1)
+		th := threads[0]
+		var pv pvList
+		pv.new()
+		if got := search(-50, 50, 3, 1, &pv, th, false); got != -50 || !searchStop.isSet() {
+			t.Fatalf("nodes %v: the stopped search should return alpha -50 but we got %v (stopped=%v)", nodes, got, searchStop.isSet())
+		}
+		if mv, _, _, _ := trans.retrieve(th.b.fullKey(), 0, 1); mv != noMove {
+			t.Errorf("nodes %v: the stopped node should not store %v in the transposition table", nodes, mv.String())
+		}
+		if k := th.killers[1]; k.k1 != noMove || k.k2 != noMove {
+			t.Errorf("nodes %v: the stopped node should not add killers but we got %v %v", nodes, k.k1.String(), k.k2.String())
+		}
+	}
+}
+
+func Test_lmrTab(t *testing.T) {
+	for m := 0; m < 64; m++ {
+		if lmrTab[1][m] != 0 {
+			t.Errorf("no reduction at depth 1 but lmrTab[1][%v]=%v", m, lmrTab[1][m])
+		}
+	}
+	for d := 2; d < maxDepth; d++ {
+		for m := 2; m < 64; m++ {
+			if lmrTab[d][m] < lmrTab[d-1][m] || lmrTab[d][m] < lmrTab[d][m-1] {
+				t.Errorf("lmrTab[%v][%v]=%v must not be smaller than for a lower depth or move number", d, m, lmrTab[d][m])
+			}
+		}
+	}
+	if lmrTab[3][4] != 1 || lmrTab[10][20] != 3 {
+		t.Errorf("lmrTab[3][4]=%v should be 1 and lmrTab[10][20]=%v should be 3", lmrTab[3][4], lmrTab[10][20])
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// The hash file is the transposition table saved to disk. Little endian:
+//
+//	magic      8 bytes "GOBITTT\n"
+//	version    uint32
+//	age        uint32
+//	entries    uint64
+//	seed       int64   the seed for the random keys
+//	keysCheck  uint64  a check sum of the random keys
+//	entries x (key uint64, data uint64)
+const (
+	hashMagic   = "GOBITTT\n"
+	hashVersion = 1
+)
+
+type hashHeader struct {
+	Magic     [8]byte
+	Version   uint32
+	Age       uint32
+	Entries   uint64
+	Seed      int64
+	KeysCheck uint64
+}
+
+// zobristCheck returns a check sum of the random keys. The positions in a hash file are useless with other keys
+func zobristCheck() uint64 {
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, randPcSq[:])
+	binary.Write(h, binary.LittleEndian, randEp[:])
+	binary.Write(h, binary.LittleEndian, randCastl[:])
+	return h.Sum64()
+}
+
+// save writes the transposition table to the file
+func (t *transpStruct) save(fileName string) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return fmt.Errorf("savehash: %v", err)
+	}
+	w := bufio.NewWriter(f)
+
+	hdr := hashHeader{Version: hashVersion, Age: uint32(t.age), Entries: uint64(t.entries), Seed: zobristSeed, KeysCheck: zobristCheck()}
+	copy(hdr.Magic[:], hashMagic)
+	err = binary.Write(w, binary.LittleEndian, &hdr)
+	var buf [16]byte
+	for i := 0; i < len(t.tab) && err == nil; i++ {
+		for j := 0; j < bucketEntries && err == nil; j++ {
+			e := &t.tab[i][j]
+			binary.LittleEndian.PutUint64(buf[:8], atomic.LoadUint64(&e.key))
+			binary.LittleEndian.PutUint64(buf[8:], atomic.LoadUint64((*uint64)(&e.data)))
+			_, err = w.Write(buf[:])
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if errClose := f.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		return fmt.Errorf("savehash %v: %v", fileName, err)
+	}
+	return nil
+}
+
+// load reads a transposition table saved by save. The file must have the same random keys.
+// If the file has another number of entries than the table, the entries are stored in the table one by one.
+// The file is read into a new table that replaces t only if the whole file is ok
+func (t *transpStruct) load(fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("loadhash: %v", err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var hdr hashHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return fmt.Errorf("loadhash %v: no header: %v", fileName, err)
+	}
+	switch {
+	case string(hdr.Magic[:]) != hashMagic:
+		return fmt.Errorf("loadhash %v: not a hash file", fileName)
+	case hdr.Version != hashVersion:
+		return fmt.Errorf("loadhash %v: version %v but we need version %v", fileName, hdr.Version, hashVersion)
+	case hdr.Seed != zobristSeed || hdr.KeysCheck != zobristCheck():
+		return fmt.Errorf("loadhash %v: the file is made with other random keys", fileName)
+	case hdr.Entries == 0 || hdr.Entries%bucketEntries != 0 || hdr.Age > ageMask:
+		return fmt.Errorf("loadhash %v: %v entries and age %v is not valid", fileName, hdr.Entries, hdr.Age)
+	}
+
+	nt := transpStruct{entries: t.entries, mask: t.mask, tab: make([]ttBucket, len(t.tab))}
+	nt.clear()
+	nt.age = int(hdr.Age)
+	sameSize := hdr.Entries == uint64(nt.entries)
+	var buf [16]byte
+	for i := uint64(0); i < hdr.Entries; i++ {
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return fmt.Errorf("loadhash %v: entry %v: %v", fileName, i, err)
+		}
+		key := binary.LittleEndian.Uint64(buf[:8])
+		d := ttData(binary.LittleEndian.Uint64(buf[8:]))
+		if sameSize {
+			nt.tab[i/bucketEntries][i%bucketEntries] = ttEntry{key, d}
+			continue
+		}
+		if d.depth() < 0 { // empty
+			continue
+		}
+		fullKey := key ^ uint64(d)
+		nt.victim(&nt.tab[nt.index(fullKey)]).save(fullKey, d)
+	}
+	*t = nt
+	return nil
+}
+
+// handleSaveHash saves the transposition table: savehash [file]. The default file is the Hash File option
+func handleSaveHash(words []string) {
+	if searching {
+		tell("info string savehash is not possible while the engine is searching")
+		return
+	}
+	fileName := hashFileName(words)
+	if err := trans.save(fileName); err != nil {
+		tell("info string ", err.Error())
+		return
+	}
+	tell(fmt.Sprintf("info string hash saved to %v with %v entries", fileName, trans.entries))
+}
+
+// handleLoadHash loads the transposition table: loadhash [file]. The default file is the Hash File option
+func handleLoadHash(words []string) {
+	if searching {
+		tell("info string loadhash is not possible while the engine is searching")
+		return
+	}
+	fileName := hashFileName(words)
+	if err := trans.load(fileName); err != nil {
+		tell("info string ", err.Error())
+		return
+	}
+	tell(fmt.Sprintf("info string hash loaded from %v", fileName))
+}
+
+func hashFileName(words []string) string {
+	if len(words) > 1 {
+		return trim(strings.Join(words[1:], " "))
+	}
+	return findOption("Hash File").val
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fillTrans stores n entries with the score and depth taken from the index
+func fillTrans(tt *transpStruct, n int) {
+	for i := 0; i < n; i++ {
+		var mv move
+		mv.packMove(i%64, (i+8)%64, wR, empty, empty, 0, 0)
+		tt.store(uint64(i)*0x9E3779B97F4A7C15, mv, 1+i%30, 0, i%2000-1000, scoreTypeBetween)
+	}
+}
+
+// checkTrans returns the number of entries from fillTrans that are not found with the right data
+func checkTrans(tt *transpStruct, n int) int {
+	missing := 0
+	for i := 0; i < n; i++ {
+		var mv move
+		mv.packMove(i%64, (i+8)%64, wR, empty, empty, 0, 0)
+		gotMv, sc, typ, ok := tt.retrieve(uint64(i)*0x9E3779B97F4A7C15, 0, 0)
+		if !ok || gotMv != mv || sc != i%2000-1000 || typ != scoreTypeBetween {
+			missing++
+		}
+	}
+	return missing
+}
+
+func Test_saveLoadHash(t *testing.T) {
+	tell = testTell
+	fileName := filepath.Join(t.TempDir(), "test.hash")
+	var tt transpStruct
+	tt.new(minHash)
+	tt.age = 17
+	fillTrans(&tt, 5000)
+	if err := tt.save(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		mB   int
+	}{
+		{"same size", minHash},
+		{"bigger table", 2 * minHash},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var tt2 transpStruct
+			tt2.new(tc.mB)
+			if err := tt2.load(fileName); err != nil {
+				t.Fatalf("%v: %v", tc.name, err)
+			}
+			if tt2.age != 17 {
+				t.Errorf("%v: age should be 17 but is %v", tc.name, tt2.age)
+			}
+			if missing := checkTrans(&tt2, 5000); missing > 0 {
+				t.Errorf("%v: %v of 5000 entries are missing after load", tc.name, missing)
+			}
+		})
+	}
+}
+
+func Test_loadHashRefused(t *testing.T) {
+	tell = testTell
+	dir := t.TempDir()
+	var tt transpStruct
+	tt.new(minHash)
+	fillTrans(&tt, 100)
+	good := filepath.Join(dir, "good.hash")
+	if err := tt.save(good); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(name string, b []byte) string {
+		fileName := filepath.Join(dir, name)
+		if err := os.WriteFile(fileName, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fileName
+	}
+	badVersion := append([]byte{}, data...)
+	badVersion[8] = 99
+	tests := []struct {
+		name     string
+		fileName string
+		otherKey bool // load with another randPcSq
+		want     string
+	}{
+		{"no file", filepath.Join(dir, "nofile.hash"), false, "no such file"},
+		{"not a hash file", write("text.hash", []byte("this is not a hash file at all, not at all")), false, "not a hash file"},
+		{"too short", write("short.hash", data[:10]), false, "no header"},
+		{"version", write("version.hash", badVersion), false, "version 99"},
+		{"truncated", write("truncated.hash", data[:len(data)-8]), false, "entry"},
+		{"other keys", good, true, "other random keys"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var tt2 transpStruct
+			tt2.new(minHash)
+			fillTrans(&tt2, 100)
+			if tc.otherKey {
+				save := randPcSq[0]
+				randPcSq[0]++
+				defer func() { randPcSq[0] = save }()
+			}
+			err := tt2.load(tc.fileName)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("%v: the error should contain %#v but we got %v", tc.name, tc.want, err)
+			}
+			if checkTrans(&tt2, 100) != 0 {
+				t.Errorf("%v: the table should not be changed when the file is refused", tc.name)
+			}
+		})
+	}
+}
+
+func Test_handleSaveLoadHash(t *testing.T) {
+	tell = testTell
+	fileName := filepath.Join(t.TempDir(), "uci.hash")
+	defer findOption("Hash File").set(findOption("Hash File").def)
+
+	clearGUI()
+	handleSaveHash([]string{"savehash", fileName})
+	handleLoadHash([]string{"loadhash", fileName})
+	findOption("Hash File").set(fileName)
+	findOption("Load Hash").set("")
+	findOption("Save Hash").set("")
+	wanted := []string{"info string hash saved to " + fileName, "info string hash loaded from " + fileName,
+		"info string hash loaded from " + fileName, "info string hash saved to " + fileName}
+	if want, ok := findInGUI(wanted); !ok {
+		t.Errorf("we want %#v but we got %#v", want, guiLines())
+	}
+}
+
+func Test_hashWhileSearching(t *testing.T) {
+	tell = testTell
+	input := make(chan string)
+	go uci(input)
+	waitForGUI(1)
+
+	input <- "position startpos"
+	clearGUI()
+	input <- "go infinite"
+	input <- "savehash " + filepath.Join(t.TempDir(), "searching.hash")
+	input <- "loadhash " + filepath.Join(t.TempDir(), "searching.hash")
+	input <- "setoption name Load Hash"
+	input <- "stop"
+	wanted := []string{"info string savehash is not possible while the engine is searching",
+		"info string loadhash is not possible while the engine is searching",
+		"info string loadhash is not possible while the engine is searching", "bestmove"}
+	if want, ok := findInGUI(wanted); !ok {
+		t.Errorf("we want %#v but we got %#v", want, guiLines())
+	}
+	quitUci(input)
+}
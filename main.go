@@ -12,6 +12,10 @@ func init() {
 	initAtksKings()
 	initAtksKnights()
 	initCastlings()
+	initKeys()
 	pSqInit()
+	initLMR()
+	initOptions()
+	trans.new(defaultHash)
 	board.newGame()
 }
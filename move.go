@@ -41,9 +41,15 @@ func init() {
 	pieceRules[Rook] = append(pieceRules[Rook], W)
 }
 
+// String returns the move in uci format (e2e4, e7e8q). noMove is "0000"
 func (m move) String() string {
-	s := m.StringFull()
-	s = s[1:3] + s[5:]
+	if m.onlyMv() == noMove {
+		return "0000"
+	}
+	s := sq2Fen[m.fr()] + sq2Fen[m.to()]
+	if m.pr() != empty {
+		s += low(int2Fen(m.pr()))
+	}
 	return s
 }
 
@@ -100,21 +106,9 @@ func (m move) pc() int {
 	return int(m&p12Mask) >> p12Shift
 }
 
+// ep returns the ep square that was valid before the move (packMove stores the full square)
 func (m move) ep(sd colour) int {
-	// sd is the side that can capture
-	file := int(m&epMask) >> epShift
-	if file == 0 {
-		return 0 // no ep
-	}
-
-	// there is an ep sq
-	rank := 5
-	if sd == BLACK {
-		rank = 2
-	}
-
-	return rank*8 + file - 1
-
+	return int(m&epMask) >> epShift
 }
 
 func (m move) cp() int {
@@ -154,6 +148,22 @@ func (ml *moveList) remove(ix int) {
 	}
 }
 
+// keep removes all moves that are not in mvs (uci format)
+func (ml *moveList) keep(mvs []string) {
+	for ix := len(*ml) - 1; ix >= 0; ix-- {
+		found := false
+		for _, s := range mvs {
+			if (*ml)[ix].String() == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ml.remove(ix)
+		}
+	}
+}
+
 func (ml *moveList) sort() {
 	bSwap := true
 	for bSwap {
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// uci option types
+const (
+	optSpin   = "spin"
+	optCheck  = "check"
+	optCombo  = "combo"
+	optButton = "button"
+	optString = "string"
+)
+
+// uciOption is one engine option that is sent to the GUI in handleUci and changed with setoption
+type uciOption struct {
+	name     string
+	typ      string // spin, check, combo, button or string
+	def      string // default value (not for buttons)
+	min, max int    // only for spin
+	vars     []string
+	val      string                   // current value
+	apply    func(o *uciOption) error // called after the value is changed or the button is pressed
+}
+
+// all options in the order they are sent to the GUI
+var options []*uciOption
+
+// addOption registers an option and sets its value to the default value
+func addOption(o uciOption) {
+	o.val = o.def
+	options = append(options, &o)
+}
+
+// initOptions registers all engine options
+func initOptions() {
+	options = options[:0]
+	addOption(uciOption{name: "Hash", typ: optSpin, def: strconv.Itoa(defaultHash), min: minHash, max: maxHash,
+		apply: func(o *uciOption) error { return trans.new(o.spin()) }})
+	addOption(uciOption{name: "Clear Hash", typ: optButton,
+		apply: func(o *uciOption) error { trans.clear(); tell("info string Hash cleared"); return nil }})
+	addOption(uciOption{name: "Hash File", typ: optString, def: "gobit.hash"})
+	addOption(uciOption{name: "Save Hash", typ: optButton,
+		apply: func(o *uciOption) error { handleSaveHash(nil); return nil }})
+	addOption(uciOption{name: "Load Hash", typ: optButton,
+		apply: func(o *uciOption) error { handleLoadHash(nil); return nil }})
+	addOption(uciOption{name: "Threads", typ: optSpin, def: "1", min: 1, max: 16})
+	addOption(uciOption{name: "MultiPV", typ: optSpin, def: "1", min: 1, max: 64})
+	addOption(uciOption{name: "Ponder", typ: optCheck, def: "false"})
+	addOption(uciOption{name: "Move Overhead", typ: optSpin, def: "50", min: 0, max: 5000})
+	addOption(uciOption{name: "Contempt", typ: optSpin, def: "0", min: -100, max: 100})
+}
+
+// findOption returns the option with the given name (not case sensitive) or nil if not found
+func findOption(name string) *uciOption {
+	for _, o := range options {
+		if strings.EqualFold(o.name, name) {
+			return o
+		}
+	}
+	return nil
+}
+
+// set validates the value and applies it
+func (o *uciOption) set(value string) error {
+	switch o.typ {
+	case optSpin:
+		v, err := strconv.Atoi(value)
+		if err != nil || v < o.min || v > o.max {
+			return fmt.Errorf("%v value %v must be a number between %v and %v", o.name, value, o.min, o.max)
+		}
+		value = strconv.Itoa(v)
+	case optCheck:
+		value = low(value)
+		if value != "true" && value != "false" {
+			return fmt.Errorf("%v value %v must be true or false", o.name, value)
+		}
+	case optCombo:
+		found := false
+		for _, v := range o.vars {
+			if strings.EqualFold(v, value) {
+				value, found = v, true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%v value %v must be one of %v", o.name, value, strings.Join(o.vars, ", "))
+		}
+	case optString:
+		if value == "<empty>" {
+			value = ""
+		}
+	case optButton:
+		value = ""
+	}
+
+	o.val = value
+	if o.apply != nil {
+		return o.apply(o)
+	}
+	return nil
+}
+
+// spin returns the value of a spin option
+func (o *uciOption) spin() int {
+	v, _ := strconv.Atoi(o.val)
+	return v
+}
+
+// check returns the value of a check option
+func (o *uciOption) check() bool {
+	return o.val == "true"
+}
+
+// String returns the option as it is sent to the GUI
+func (o *uciOption) String() string {
+	s := fmt.Sprintf("option name %v type %v", o.name, o.typ)
+	switch o.typ {
+	case optSpin:
+		s += fmt.Sprintf(" default %v min %v max %v", o.def, o.min, o.max)
+	case optCheck, optCombo:
+		s += " default " + o.def
+		for _, v := range o.vars {
+			s += " var " + v
+		}
+	case optString:
+		def := o.def
+		if def == "" {
+			def = "<empty>"
+		}
+		s += " default " + def
+	}
+	return s
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// perft returns the number of leaf nodes at depth. It is used to verify the move generator
+func (b *boardStruct) perft(depth int) uint64 {
+	if depth <= 0 {
+		return 1
+	}
+	var ml moveList
+	ml.new(60)
+	b.genAllMoves(&ml)
+	nodes := uint64(0)
+	for _, mv := range ml {
+		if !b.move(mv) {
+			continue
+		}
+		nodes += b.perft(depth - 1)
+		b.unmove(mv)
+	}
+	return nodes
+}
+
+// divide returns the perft numbers for each legal move in the position
+func (b *boardStruct) divide(depth int) (moveList, []uint64) {
+	var ml, legals moveList
+	var nodes []uint64
+	ml.new(60)
+	b.genAllMoves(&ml)
+	for _, mv := range ml {
+		if !b.move(mv) {
+			continue
+		}
+		legals = append(legals, mv)
+		nodes = append(nodes, b.perft(depth-1))
+		b.unmove(mv)
+	}
+	return legals, nodes
+}
+
+// handlePerft handles the debug commands perft <depth> and divide <depth>
+func handlePerft(words []string) {
+	if len(words) < 2 {
+		tell("info string ", words[0], " needs a depth")
+		return
+	}
+	depth, err := strconv.Atoi(words[1])
+	if err != nil || depth < 1 {
+		tell("info string ", words[0], " depth ", words[1], " is not a valid depth")
+		return
+	}
+
+	start := time.Now()
+	nodes := uint64(0)
+	if words[0] == "divide" {
+		ml, cnts := board.divide(depth)
+		for ix, mv := range ml {
+			tell(fmt.Sprintf("%v: %v", mv.String(), cnts[ix]))
+			nodes += cnts[ix]
+		}
+		tell(fmt.Sprintf("info string moves %v", len(ml)))
+	} else {
+		nodes = board.perft(depth)
+	}
+	elapsed := time.Since(start)
+	nps := uint64(0)
+	if elapsed.Seconds() > 0 {
+		nps = uint64(float64(nodes) / elapsed.Seconds())
+	}
+	tell(fmt.Sprintf("info string %v %v nodes %v time %v nps %v", words[0], depth, nodes, elapsed.Milliseconds(), nps))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+var perftLong = flag.Bool("perftlong", false, "run the perft tests to a higher depth")
+
+func Test_perft(t *testing.T) {
+	tests := []struct {
+		name  string
+		pos   string
+		nodes []uint64 // perft 1, 2, 3...
+		short int      // depth in short mode
+	}{
+		{"startpos", "position startpos",
+			[]uint64{20, 400, 8902, 197281, 4865609, 119060324}, 4},
+		{"kiwipete", "position fen r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+			[]uint64{48, 2039, 97862, 4085603, 193690690}, 3},
+		{"position 3", "position fen 8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1",
+			[]uint64{14, 191, 2812, 43238, 674624, 11030083}, 4},
+		{"position 4", "position fen r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1",
+			[]uint64{6, 264, 9467, 422333, 15833292}, 3},
+		{"position 4 mirrored", "position fen r2q1rk1/pP1p2pp/Q4n2/bbp1p3/Np6/1B3NBn/pPPP1PPP/R3K2R b KQ - 0 1",
+			[]uint64{6, 264, 9467, 422333, 15833292}, 3},
+		{"position 5", "position fen rnbq1k1r/pp1Pbppp/2p5/8/2B5/8/PPP1NnPP/RNBQK2R w KQ - 1 8",
+			[]uint64{44, 1486, 62379, 2103487, 89941194}, 3},
+		{"position 6", "position fen r4rk1/1pp1qppp/p1np1n2/2b1p1B1/2B1P1b1/P1NP1N2/1PP1QPPP/R4RK1 w - - 0 10",
+			[]uint64{46, 2079, 89890, 3894594, 164075551}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			maxDepth := tt.short
+			if *perftLong {
+				maxDepth = tt.short + 2
+			}
+			if maxDepth > len(tt.nodes) {
+				maxDepth = len(tt.nodes)
+			}
+			handlePosition(tt.pos)
+			for depth := 1; depth <= maxDepth; depth++ {
+				if got := board.perft(depth); got != tt.nodes[depth-1] {
+					t.Errorf("%v: perft %v should be %v but we got %v", tt.name, depth, tt.nodes[depth-1], got)
+					return
+				}
+			}
+		})
+	}
+}
+
+func Test_divide(t *testing.T) {
+	handlePosition("position fen r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1")
+	ml, cnts := board.divide(2)
+	if len(ml) != 48 {
+		t.Errorf("divide 2 should have 48 moves but we got %v", len(ml))
+	}
+	sum := uint64(0)
+	for _, c := range cnts {
+		sum += c
+	}
+	if sum != 2039 {
+		t.Errorf("divide 2 should sum to 2039 but we got %v", sum)
+	}
+}
+
+// Test_genCaptNonCapt checks that genAllCaptures and genAllNonCaptures together generate the same moves as genAllMoves
+func Test_genCaptNonCapt(t *testing.T) {
+	positions := []string{
+		"position startpos",
+		"position fen r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+		"position fen 8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1",
+		"position fen r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1",
+		"position fen rnbq1k1r/pp1Pbppp/2p5/8/2B5/8/PPP1NnPP/RNBQK2R w KQ - 1 8",
+		"position fen r4rk1/1pp1qppp/p1np1n2/2b1p1B1/2B1P1b1/P1NP1N2/1PP1QPPP/R4RK1 w - - 0 10",
+	}
+	var check func(pos string, depth int)
+	check = func(pos string, depth int) {
+		var all, split moveList
+		board.genAllMoves(&all)
+		board.genAllCaptures(&split)
+		board.genAllNonCaptures(&split)
+		cnt := map[move]int{}
+		for _, mv := range all {
+			cnt[mv.onlyMv()]++
+		}
+		for _, mv := range split {
+			cnt[mv.onlyMv()]--
+		}
+		for mv, c := range cnt {
+			if c != 0 {
+				t.Errorf("%v: move %v generated %v times more by genAllMoves than by genAllCaptures+genAllNonCaptures", pos, mv.String(), c)
+			}
+		}
+		if depth <= 1 {
+			return
+		}
+		for _, mv := range all {
+			if board.move(mv) {
+				check(pos+" "+mv.String(), depth-1)
+				board.unmove(mv)
+			}
+		}
+	}
+	for _, pos := range positions {
+		handlePosition(pos)
+		check(pos+" moves", 3)
+	}
+}
+
+// Test_genEvasions checks that genEvasions gives the same legal moves as genAllMoves in all positions with check
+func Test_genEvasions(t *testing.T) {
+	positions := []string{
+		"position fen r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+		"position fen 8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1",
+		"position fen r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1",
+		"position fen rnbq1k1r/pp1Pbppp/2p5/8/2B5/8/PPP1NnPP/RNBQK2R w KQ - 1 8",
+		"position fen 8/8/8/2k5/3Pp3/8/8/4K3 b - d3 0 1",  // ep capture of the checker
+		"position fen 4k3/8/8/8/8/8/1p6/R3K2r w Q - 0 1",  // castling out of check is not allowed
+		"position fen 4k3/8/5N2/8/1b6/8/8/4K2R b K - 0 1", // double check
+		"position fen 3r2k1/2P5/8/8/8/8/8/3K4 w - - 0 1",  // promotion to block or capture
+		"position fen 4k3/8/8/8/1b6/8/3P4/4K3 w - - 0 1",  // pawn blocks with one or two steps
+	}
+	cntChecks := 0
+	var check func(pos string, depth int)
+	check = func(pos string, depth int) {
+		var all moveList
+		board.genAllMoves(&all)
+		if board.inCheck() {
+			cntChecks++
+			var evasions moveList
+			board.genEvasions(&evasions)
+			board.filterLegals(&all)
+			board.filterLegals(&evasions)
+			cnt := map[move]int{}
+			for _, mv := range all {
+				cnt[mv.onlyMv()]++
+			}
+			for _, mv := range evasions {
+				cnt[mv.onlyMv()]--
+			}
+			for mv, c := range cnt {
+				if c != 0 {
+					t.Errorf("%v: move %v generated %v times more by genAllMoves than by genEvasions", pos, mv.String(), c)
+				}
+			}
+		}
+		if depth <= 1 {
+			return
+		}
+		for _, mv := range all {
+			if board.move(mv) {
+				check(pos+" "+mv.String(), depth-1)
+				board.unmove(mv)
+			}
+		}
+	}
+	for _, pos := range positions {
+		handlePosition(pos)
+		check(pos+" moves", 3)
+	}
+	if cntChecks < 100 {
+		t.Errorf("only %v positions with check are tested", cntChecks)
+	}
+}
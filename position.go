@@ -154,10 +154,19 @@ type boardStruct struct {
 	King    [2]int
 	ep      int
 	castlings
-	stm    colour
-	count  [12]int
-	rule50 int //set to 0 if a pawn or capt move otherwise increment
+	stm      colour
+	count    [12]int
+	rule50   int          //set to 0 if a pawn or capt move otherwise increment
+	fullMove int          // starts with 1 and is incremented after each black move
+	hist     []histStruct // one entry for each move made. Used for unmove and repetitions
 }
+
+// histStruct keeps what we need to undo a move and to find repetitions
+type histStruct struct {
+	key    uint64 // the key before the move
+	rule50 int    // rule50 before the move
+}
+
 type colour int
 
 var board = boardStruct{}
@@ -315,10 +324,20 @@ func (b *boardStruct) isLegal(mv move) bool {
 	return true
 }
 
+// copy returns a copy of the board with its own move history
+func (b *boardStruct) copy() boardStruct {
+	c := *b
+	c.hist = append(make([]histStruct, 0, len(b.hist)+maxPly), b.hist...)
+	return c
+}
+
 // clear the board, flags, bitboards etc
 func (b *boardStruct) clear() {
+	b.key = 0
 	b.stm = WHITE
 	b.rule50 = 0
+	b.fullMove = 1
+	b.hist = b.hist[:0]
 	b.sq = [64]int{}
 	b.King = [2]int{}
 	b.ep = 0
@@ -343,10 +362,17 @@ func (b *boardStruct) clear() {
 func (b *boardStruct) move(mv move) bool {
 	newEp := 0
 	// we assume that the move is legally correct (except inChekc())
+	b.hist = append(b.hist, histStruct{b.key, b.rule50})
+	b.key ^= epKey(b.ep) ^ castlKey(uint(b.castlings)) // remove the old ep and castling states from the key
 	fr := mv.fr()
 	to := mv.to()
 	pr := int(mv.pr())
 	p12 := b.sq[fr]
+	if piece(p12) == Pawn || b.sq[to] != empty {
+		b.rule50 = 0
+	} else {
+		b.rule50++
+	}
 	switch {
 	case p12 == wK:
 		b.castlings.off(shortW | longW)
@@ -400,7 +426,19 @@ func (b *boardStruct) move(mv move) bool {
 			b.setSq(empty, to+8)
 		}
 	}
+	switch to { // a rook captured on its home square can't castle any more
+	case A1:
+		b.castlings.off(longW)
+	case H1:
+		b.castlings.off(shortW)
+	case A8:
+		b.castlings.off(longB)
+	case H8:
+		b.castlings.off(shortB)
+	}
+
 	b.ep = newEp
+	b.key ^= epKey(b.ep) ^ castlKey(uint(b.castlings)) // add the new ep and castling states to the key
 	b.setSq(empty, fr)
 
 	if pr != empty {
@@ -409,15 +447,55 @@ func (b *boardStruct) move(mv move) bool {
 		b.setSq(p12, to)
 	}
 
+	if b.stm == BLACK {
+		b.fullMove++
+	}
 	b.stm = b.stm ^ 0x1
+	b.key = flipSide(b.key)
 	if b.isAttacked(b.King[b.stm^0x1], b.stm) {
 		b.unmove(mv)
 		return false
 	}
 
+	if debug {
+		assertKey(b, "move "+mv.String())
+	}
 	return true
 }
 
+// moveNull makes a null move (only the side to move is changed). It returns the old ep square for unmoveNull
+func (b *boardStruct) moveNull() int {
+	ep := b.ep
+	b.hist = append(b.hist, histStruct{b.key, b.rule50})
+	b.key ^= epKey(b.ep)
+	b.ep = 0
+	b.rule50 = 0 // no repetitions over a null move
+	b.stm = b.stm ^ 0x1
+	b.key = flipSide(b.key)
+	if debug {
+		assertKey(b, "moveNull")
+	}
+	return ep
+}
+
+// unmoveNull takes back a null move. ep is the ep square returned from moveNull
+func (b *boardStruct) unmoveNull(ep int) {
+	b.stm = b.stm ^ 0x1
+	b.key = flipSide(b.key)
+	b.ep = ep
+	b.key ^= epKey(b.ep)
+	b.rule50 = b.hist[len(b.hist)-1].rule50
+	b.hist = b.hist[:len(b.hist)-1]
+	if debug {
+		assertKey(b, "unmoveNull")
+	}
+}
+
+// hasPieces returns true if sd has other pieces than king and pawns
+func (b *boardStruct) hasPieces(sd colour) bool {
+	return (b.pieceBB[Knight]|b.pieceBB[Bishop]|b.pieceBB[Rook]|b.pieceBB[Queen])&b.wbBB[sd] != 0
+}
+
 func (c colour) String() string {
 	if c == WHITE {
 		return "W"
@@ -426,8 +504,14 @@ func (c colour) String() string {
 }
 
 func (b *boardStruct) unmove(mv move) {
+	if len(b.hist) > 0 {
+		b.rule50 = b.hist[len(b.hist)-1].rule50
+		b.hist = b.hist[:len(b.hist)-1]
+	}
+	b.key ^= epKey(b.ep) ^ castlKey(uint(b.castlings))
 	b.ep = int(mv.ep(b.stm))
 	b.castlings = mv.castl()
+	b.key ^= epKey(b.ep) ^ castlKey(uint(b.castlings))
 	p12 := int(mv.p12())
 	fr := int(mv.fr())
 	to := int(mv.to())
@@ -435,7 +519,7 @@ func (b *boardStruct) unmove(mv move) {
 	b.setSq(p12, fr)
 
 	if piece(p12) == Pawn {
-		if to == b.ep { // ep move
+		if to == b.ep && b.ep != 0 { // ep move
 			b.setSq(empty, to)
 			switch to - fr {
 			case NW, NE:
@@ -455,6 +539,14 @@ func (b *boardStruct) unmove(mv move) {
 		}
 	}
 	b.stm = b.stm ^ 0x1
+	b.key = flipSide(b.key)
+	if b.stm == BLACK {
+		b.fullMove--
+	}
+
+	if debug {
+		assertKey(b, "unmove "+mv.String())
+	}
 }
 
 func (b *boardStruct) setSq(p12, sq int) {
@@ -466,6 +558,7 @@ func (b *boardStruct) setSq(p12, sq int) {
 		b.count[cp]--
 		b.wbBB[sd^0x1].clr(sq)
 		b.pieceBB[piece(cp)].clr(sq)
+		b.key ^= pcSqKey(cp, sq)
 	}
 	b.sq[sq] = p12
 
@@ -479,6 +572,7 @@ func (b *boardStruct) setSq(p12, sq int) {
 	}
 
 	b.count[p12]++
+	b.key ^= pcSqKey(p12, sq)
 
 	if p == King {
 		b.King[sd] = sq
@@ -941,7 +1035,7 @@ func (b *boardStruct) genWPawnNonCapt(ml *moveList) {
 	// one step
 	to1Step := (wPawns << N) & ^b.allBB()
 	//two steps
-	to2Step := ((wPawns & row3) << N) & ^b.allBB()
+	to2Step := ((to1Step & row3) << N) & ^b.allBB()
 	to1Step &= ^row8
 
 	// Add one step forward
@@ -1143,6 +1237,111 @@ func (b *boardStruct) isAttacked(sq int, sd colour) bool {
 	return false
 }
 
+// attackersTo returns the pieces of the sd color side that attack sq
+func (b *boardStruct) attackersTo(sq int, sd colour) bitBoard {
+	pawns := b.bPawnAtksFr(sq) // white pawns that attack sq
+	if sd == BLACK {
+		pawns = b.wPawnAtksFr(sq)
+	}
+	atkBB := pawns&b.pieceBB[Pawn] |
+		atksKnights[sq]&b.pieceBB[Knight] |
+		atksKings[sq]&b.pieceBB[King] |
+		mBishopTab[sq].atks(b.allBB())&(b.pieceBB[Bishop]|b.pieceBB[Queen]) |
+		mRookTab[sq].atks(b.allBB())&(b.pieceBB[Rook]|b.pieceBB[Queen])
+	return atkBB & b.wbBB[sd]
+}
+
+// genEvasions generates the pseudo legal moves when the side to move is in check:
+// king moves (not castlings), captures of the checker and interpositions on the check ray.
+// In double check only the king can move. Moves that leave the king in check are rejected by move()
+func (b *boardStruct) genEvasions(ml *moveList) {
+	us, them := b.stm, b.stm.opp()
+	kSq := b.King[us]
+	var mv move
+
+	// king moves
+	p12 := pc2P12(King, us)
+	toBB := atksKings[kSq] & ^b.wbBB[us]
+	for to := toBB.firstOne(); to != 64; to = toBB.firstOne() {
+		mv.packMove(kSq, to, p12, b.sq[to], empty, b.ep, b.castlings)
+		ml.add(mv)
+	}
+
+	checkers := b.attackersTo(kSq, them)
+	if checkers.count() != 1 {
+		return
+	}
+	chSq := checkers.firstOne()
+
+	// the squares between the king and a checking slider. Only the line between them is in both attack sets
+	targetBB := bitBoard(1) << uint(chSq)
+	if pt := piece(b.sq[chSq]); pt == Rook || pt == Bishop || pt == Queen {
+		if kSq/8 == chSq/8 || kSq%8 == chSq%8 {
+			targetBB |= mRookTab[kSq].atks(b.allBB()) & mRookTab[chSq].atks(b.allBB())
+		} else {
+			targetBB |= mBishopTab[kSq].atks(b.allBB()) & mBishopTab[chSq].atks(b.allBB())
+		}
+	}
+
+	b.genKnightMoves(ml, targetBB)
+	b.genBishopMoves(ml, targetBB)
+	b.genRookMoves(ml, targetBB)
+	b.genQueenMoves(ml, targetBB)
+
+	// pawns. An ep capture takes the checker if it is the pawn that just moved two steps
+	epPawn := b.ep - 8 // the pawn that can be taken ep
+	if us == BLACK {
+		epPawn = b.ep + 8
+	}
+	epChecker := b.ep != 0 && chSq == epPawn
+	var pawnMoves moveList
+	pawnMoves.new(20)
+	b.genPawnMoves(&pawnMoves)
+	for _, mv := range pawnMoves {
+		if targetBB.test(mv.to()) || (epChecker && mv.to() == b.ep) {
+			ml.add(mv)
+		}
+	}
+}
+
+// isRepetition returns true if the position is repeated. A position in the search path (after root)
+// needs only to be repeated once. A position before root must be repeated twice (threefold repetition)
+func (b *boardStruct) isRepetition(ply int) bool {
+	cnt := 0
+	n := len(b.hist)
+	for ix := n - 4; ix >= 0 && ix >= n-b.rule50; ix -= 2 { // same side to move and no pawn move or capture
+		if b.hist[ix].key == b.key {
+			if ix >= n-ply {
+				return true
+			}
+			cnt++
+			if cnt >= 2 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inCheck returns true if the side to move is in check
+func (b *boardStruct) inCheck() bool {
+	return b.isAttacked(b.King[b.stm], b.stm.opp())
+}
+
+// hasLegalMove returns true if the side to move has at least one legal move
+func (b *boardStruct) hasLegalMove() bool {
+	var ml moveList
+	ml.new(60)
+	b.genAllMoves(&ml)
+	for _, mv := range ml {
+		if b.move(mv) {
+			b.unmove(mv)
+			return true
+		}
+	}
+	return false
+}
+
 //var pawnAtks = [2]func(*boardStruct, int) bool{(*boardStruct).wPawnAtks, (*boardStruct).bPawnAtks}
 
 func (b *boardStruct) attacksBB(us colour) bitBoard {
@@ -1182,21 +1381,21 @@ func (b *boardStruct) iswPawnAtkingSq(to int) bool {
 	wPawns := b.pieceBB[Pawn] & b.wbBB[WHITE]
 
 	// Attacks left and right
-	toCap := ((wPawns & ^fileA) >> NW) & b.wbBB[WHITE]
-	toCap |= ((wPawns & ^fileH) >> NE) & b.wbBB[WHITE]
+	toCap := ((wPawns & ^fileA) << NW)
+	toCap |= ((wPawns & ^fileH) << NE)
 
 	return (toCap & sqBB) != 0
 }
 
-// Returns true or false if to-sq is attacked by white pawn
+// Returns true or false if to-sq is attacked by black pawn
 func (b *boardStruct) isbPawnAtkingSq(to int) bool {
 	sqBB := bitBoard(1) << uint(to)
 
 	bPawns := b.pieceBB[Pawn] & b.wbBB[BLACK]
 
 	// Attacks left and right
-	toCap := ((bPawns & ^fileA) >> (-SW)) & b.wbBB[WHITE]
-	toCap |= ((bPawns & ^fileH) >> (-SE)) & b.wbBB[WHITE]
+	toCap := ((bPawns & ^fileA) >> (-SW))
+	toCap |= ((bPawns & ^fileH) >> (-SE))
 
 	return (toCap & sqBB) != 0
 }
@@ -1218,7 +1417,7 @@ func (b *boardStruct) bPawnAtkers() bitBoard {
 	BB := b.wbBB[WHITE]
 
 	ourPawnAttackers := ((BB & ^fileA) << NW) & b.wbBB[BLACK] & b.pieceBB[Pawn]
-	ourPawnAttackers |= ((BB & ^fileA) << NE) & b.wbBB[BLACK] & b.pieceBB[Pawn]
+	ourPawnAttackers |= ((BB & ^fileH) << NE) & b.wbBB[BLACK] & b.pieceBB[Pawn]
 
 	return ourPawnAttackers
 }
@@ -1239,7 +1438,7 @@ func (b *boardStruct) bPawnAtksFr(fr int) bitBoard {
 
 	//Attacks left and right
 	toCap := ((frBB & ^fileA) >> (-SW)) & b.wbBB[WHITE]
-	toCap |= ((frBB & ^fileH) << (-SE)) & b.wbBB[WHITE]
+	toCap |= ((frBB & ^fileH) >> (-SE)) & b.wbBB[WHITE]
 	return toCap
 }
 
@@ -1249,7 +1448,7 @@ func (b *boardStruct) wPawnAtksBB() bitBoard {
 
 	// Attacks left and right
 	toCap := ((frBB & ^fileA) << NW)
-	toCap |= ((frBB & ^fileA) << NE)
+	toCap |= ((frBB & ^fileH) << NE)
 
 	return toCap
 }
@@ -1273,6 +1472,13 @@ func min(a, b int) int {
 	return b
 }
 
+func max(a, b int) int {
+	if a >= b {
+		return a
+	}
+	return b
+}
+
 // print all legal moves
 func (b *boardStruct) printAllLegals() {
 	var ml moveList
@@ -1354,142 +1560,240 @@ func (b *boardStruct) printAllBB() {
 	fmt.Println((b.pieceBB[King] & b.wbBB[BLACK]).Stringln())
 }
 
-// parse a FEN string and setup that position
-func parseFEN(FEN string) {
-	board.clear()
-	fenIx := 0
-	sq := 0
+// FEN returns the position as a FEN string
+func (b *boardStruct) FEN() string {
+	fen := ""
 	for row := 7; row >= 0; row-- {
-		for sq = row * 8; sq < row*8+8; {
-
-			char := string(FEN[fenIx])
-			fenIx++
-			if char == "/" {
-				continue
-			}
-
-			if i, err := strconv.Atoi(char); err == nil { //numeriskt
-				for j := 0; j < i; j++ {
-					board.setSq(empty, sq)
-					sq++
-				}
+		cntEmpty := 0
+		for sq := row * 8; sq < row*8+8; sq++ {
+			if b.sq[sq] == empty {
+				cntEmpty++
 				continue
 			}
-
-			if strings.IndexAny(p12ToFen, char) == -1 {
-				tell("info string invalid piece ", char, " try next one")
-				continue
+			if cntEmpty > 0 {
+				fen += strconv.Itoa(cntEmpty)
+				cntEmpty = 0
 			}
+			fen += int2Fen(b.sq[sq])
+		}
+		if cntEmpty > 0 {
+			fen += strconv.Itoa(cntEmpty)
+		}
+		if row > 0 {
+			fen += "/"
+		}
+	}
 
-			board.setSq(fen2Int(char), sq)
+	stm := "w"
+	if b.stm == BLACK {
+		stm = "b"
+	}
+	ep := "-"
+	if b.ep != 0 {
+		ep = sq2Fen[b.ep]
+	}
+	return fmt.Sprintf("%v %v %v %v %v %v", fen, stm, b.castlings.String(), ep, b.rule50, b.fullMove)
+}
 
-			sq++
-		}
+// parseFEN parses a FEN string and sets up that position in board.
+// If the FEN string is not a legal position an error is returned and board is not changed
+func parseFEN(FEN string) error {
+	b, err := fenToBoard(FEN)
+	if err != nil {
+		return err
 	}
+	board = b
+	return nil
+}
 
-	remaining := strings.Split(trim(FEN[fenIx:]), " ")
+// fenToBoard returns the position in the FEN string or an error if it is not a legal position
+func fenToBoard(FEN string) (boardStruct, error) {
+	var b boardStruct
+	b.clear()
 
-	// stm
-	if len(remaining) > 0 {
-		if remaining[0] == "w" {
-			board.stm = WHITE
-		} else if remaining[0] == "b" {
-			board.stm = BLACK
-		} else {
-			r := fmt.Sprintf("%v; sq=%v;  fenIx=%v", strings.Join(remaining, " "), sq, fenIx)
+	fields := strings.Fields(FEN)
+	if len(fields) < 2 {
+		return b, fmt.Errorf("fen %#v must have at least the piece placement and the side to move", FEN)
+	}
+	if len(fields) > 6 {
+		return b, fmt.Errorf("fen %#v has too many fields", FEN)
+	}
 
-			tell("info string remaining=", r, ";")
-			tell("info string ", remaining[0], " invalid stm color")
-			board.stm = WHITE
+	// piece placement
+	rows := strings.Split(fields[0], "/")
+	if len(rows) != 8 {
+		return b, fmt.Errorf("fen %v must have 8 ranks but has %v", fields[0], len(rows))
+	}
+	for ix, row := range rows {
+		rank := 8 - ix
+		sq := (rank - 1) * 8
+		for _, char := range row {
+			if char >= '1' && char <= '8' {
+				sq += int(char - '0')
+			} else if strings.ContainsRune(p12ToFen, char) {
+				if sq < rank*8 {
+					b.setSq(fen2Int(string(char)), sq)
+				}
+				sq++
+			} else {
+				return b, fmt.Errorf("fen rank %v has an invalid piece %q", rank, char)
+			}
+			if sq > rank*8 {
+				return b, fmt.Errorf("fen rank %v (%v) has more than 8 squares", rank, row)
+			}
 		}
+		if sq < rank*8 {
+			return b, fmt.Errorf("fen rank %v (%v) has less than 8 squares", rank, row)
+		}
+	}
+	if b.count[wK] != 1 || b.count[bK] != 1 {
+		return b, fmt.Errorf("fen must have one white and one black king but has %v white and %v black", b.count[wK], b.count[bK])
+	}
+	if b.pieceBB[Pawn]&(row1|row8) != 0 {
+		return b, fmt.Errorf("fen has pawns on the first or last rank")
+	}
+
+	// stm
+	switch fields[1] {
+	case "w":
+		b.stm = WHITE
+	case "b":
+		b.stm = BLACK
+	default:
+		return b, fmt.Errorf("fen side to move %#v must be w or b", fields[1])
+	}
+	if b.isAttacked(b.King[b.stm.opp()], b.stm) {
+		return b, fmt.Errorf("fen side not to move is in check")
 	}
 
 	// castling
-	board.castlings = 0
-	if len(remaining) > 1 {
-		board.castlings = parseCastlings(remaining[1])
+	if len(fields) > 2 {
+		c, err := parseCastlings(fields[2])
+		if err != nil {
+			return b, err
+		}
+		sdName := [2]string{"white", "black"}
+		for sd := WHITE; sd <= BLACK; sd++ {
+			king := pc2P12(King, sd)
+			if c.canCastle(sd) && b.sq[castl[sd].kingPos] != king {
+				return b, fmt.Errorf("fen castling %v needs the %v king on %v", fields[2], sdName[sd], sq2Fen[castl[sd].kingPos])
+			}
+			if c.canCastleShort(sd) && b.sq[castl[sd].rookSh] != castl[sd].rook {
+				return b, fmt.Errorf("fen castling %v needs the %v rook on %v", fields[2], sdName[sd], sq2Fen[int(castl[sd].rookSh)])
+			}
+			if c.canCastleLong(sd) && b.sq[castl[sd].rookL] != castl[sd].rook {
+				return b, fmt.Errorf("fen castling %v needs the %v rook on %v", fields[2], sdName[sd], sq2Fen[int(castl[sd].rookL)])
+			}
+		}
+		b.castlings = c
 	}
 
 	// ep square
-	board.ep = 0
-	if len(remaining) > 2 {
-		if remaining[2] != "-" {
-			board.ep = fenSq2Int[remaining[2]]
+	if len(fields) > 3 && fields[3] != "-" {
+		ep, ok := fenSq2Int[fields[3]]
+		// the pawn that moved two steps must be in front of the ep square and it must have passed two empty squares
+		epRow, pawnSq, pawn := row6, ep-8, bP
+		if b.stm == BLACK {
+			epRow, pawnSq, pawn = row3, ep+8, wP
+		}
+		if !ok || (bitBoard(1)<<uint(ep))&epRow == 0 {
+			return b, fmt.Errorf("fen ep square %v is not possible with %v to move", fields[3], fields[1])
 		}
+		if b.sq[pawnSq] != pawn || b.sq[ep] != empty || b.sq[2*ep-pawnSq] != empty {
+			return b, fmt.Errorf("fen ep square %v doesn't match a pawn that moved two steps", fields[3])
+		}
+		b.ep = ep
 	}
 
 	// 50-move
-	board.rule50 = 0
-	if len(remaining) > 3 {
-		board.rule50 = parse50(remaining[3])
+	if len(fields) > 4 {
+		r50, err := parse50(fields[4])
+		if err != nil {
+			return b, err
+		}
+		b.rule50 = r50
+	}
+
+	// full move number
+	if len(fields) > 5 {
+		n, err := strconv.Atoi(fields[5])
+		if err != nil || n < 1 {
+			return b, fmt.Errorf("fen full move number %v is not a valid number > 0", fields[5])
+		}
+		b.fullMove = n
+	}
+
+	// the pieces are already in the key from setSq
+	if b.stm == BLACK {
+		b.key = flipSide(b.key)
 	}
+	b.key ^= epKey(b.ep) ^ castlKey(uint(b.castlings))
+
+	return b, nil
 }
 
 // parse 50 move rue in fenstring
-func parse50(fen50 string) int {
+func parse50(fen50 string) (int, error) {
 	r50, err := strconv.Atoi(fen50)
 	if err != nil || r50 < 0 {
-		tell("info string 50 move rule in fenstring ", fen50, " is not a valid number >= 0 ")
-		return 0
+		return 0, fmt.Errorf("fen 50 move rule %v is not a valid number >= 0", fen50)
 	}
-	return r50
+	return r50, nil
 }
 
-// parse and make the moves in position command from GUI
-func parseMvs(mvstr string) {
-
-	mvs := strings.Fields(low(mvstr))
-
-	for _, mv := range mvs {
-		mv = trim(mv)
+// parseMvs makes the moves in the position command from GUI on b.
+// It returns an error at the first move that is not a legal move in the position
+func (b *boardStruct) parseMvs(mvstr string) error {
+	for _, mv := range strings.Fields(low(mvstr)) {
 		if len(mv) < 4 || len(mv) > 5 {
-			tell("info string ", mv, " in the position command is not a correct move")
-			return
+			return fmt.Errorf("%v in the position command is not a correct move", mv)
 		}
 		// is fr square ok?
 		fr, ok := fenSq2Int[mv[:2]]
 		if !ok {
-			tell("info string ", mv, " in the position command is not a correct fr square")
-			return
+			return fmt.Errorf("%v in the position command is not a correct fr square", mv)
 		}
 
-		p12 := board.sq[fr]
+		p12 := b.sq[fr]
 		if p12 == empty {
-			tell("info string ", mv, " in the position command. fr_sq is an empty square")
-			return
+			return fmt.Errorf("%v in the position command. fr_sq is an empty square", mv)
 		}
-		pCol := p12Colour(p12)
-		if pCol != board.stm {
-			tell("info string ", mv, " in the position command. fr piece has the wrong color")
-			return
+		if p12Colour(p12) != b.stm {
+			return fmt.Errorf("%v in the position command. fr piece has the wrong color", mv)
 		}
 
 		// is to square ok?
 		to, ok := fenSq2Int[mv[2:4]]
 		if !ok {
-			tell("info string ", mv, " in the position has an incorrect to square")
-			return
+			return fmt.Errorf("%v in the position has an incorrect to square", mv)
 		}
 
 		// is the prom piece ok?
 		pr := empty
 		if len(mv) == 5 { //prom
-			if !strings.ContainsAny(mv[4:5], "QRNBqrnb") {
-				tell("info string promotion piece in ", mv, " in the position command is not correct")
-				return
+			if !strings.ContainsAny(mv[4:5], "qrnb") {
+				return fmt.Errorf("promotion piece in %v in the position command is not correct", mv)
 			}
-			pr = fen2Int(mv[4:5])
-			pr = pc2P12(pr, board.stm)
+			pr = pc2P12(piece(fen2Int(mv[4:5])), b.stm)
 		}
-		cp := board.sq[to]
 
-		var intMv move // internal move format
-		intMv.packMove(fr, to, p12, cp, pr, board.ep, board.castlings)
-
-		if !board.move(intMv) {
-			tell(fmt.Sprintf("tell info string %v-%v is an illegal move", sq2Fen[fr], sq2Fen[to]))
+		// it must be one of the legal moves
+		var ml moveList
+		ml.new(60)
+		b.genAllLegals(&ml)
+		intMv := noMove // internal move format
+		for _, legal := range ml {
+			if legal.fr() == fr && legal.to() == to && legal.pr() == pr {
+				intMv = legal
+				break
+			}
+		}
+		if intMv == noMove {
+			return fmt.Errorf("%v in the position command is an illegal move", mv)
 		}
+		b.move(intMv)
 	}
+	return nil
 }
 
 func abs(a int) int {
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"strings"
 	"testing"
 )
 
@@ -67,7 +68,7 @@ func Test_move(t *testing.T) {
 		{"", "position startpos moves b1c3 g8f6 a1b1 h8g8", []int{A1, empty, B1, wR}, 0, shortW | longB},
 		{"", "position startpos moves b1c3 g8f6 g1f3 b8c6 a1b1 a8b8 h1g1 h8g8", []int{A1, empty, B1, wR}, 0, 0},
 		{"", "position startpos moves e2e4 e7e5 e1e2 e8e7", []int{}, 0, 0},
-		{"", "position startpos moves d2d4 d7d5 b1c3 b8c6 c1f4 c8f5 e1c1 e8c8", []int{A1, empty, B1, empty, C1, wK, D1, wR, E1, empty, A8, empty, B8, empty, C8, bK, D8, bR, E8, empty},
+		{"", "position startpos moves d2d4 d7d5 b1c3 b8c6 c1f4 c8f5 d1d2 d8d7 e1c1 e8c8", []int{A1, empty, B1, empty, C1, wK, D1, wR, E1, empty, A8, empty, B8, empty, C8, bK, D8, bR, E8, empty},
 			0, 0},
 	}
 	for _, tt := range tests {
@@ -466,3 +467,334 @@ func findMoves(mlf *moveList, mvs []string) (bool, move) {
 	}
 	return true, 0
 }
+
+func Test_rule50(t *testing.T) {
+	tests := []struct {
+		name string
+		pos  string
+		want int
+	}{
+		{"startpos", "position startpos", 0},
+		{"knight moves", "position startpos moves g1f3 g8f6 b1c3", 3},
+		{"pawn move", "position startpos moves g1f3 g8f6 b1c3 e7e5", 0},
+		{"capture", "position startpos moves g1f3 e7e5 b1c3 b8c6 f3e5", 0},
+		{"from fen", "position fen 7k/8/8/8/8/8/8/R6K w - - 41 80 moves a1a2 h8g8", 43},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlePosition(tt.pos)
+			if board.rule50 != tt.want {
+				t.Errorf("%v: rule50 should be %v but we got %v", tt.name, tt.want, board.rule50)
+			}
+			// unmove must restore rule50
+			if len(board.hist) > 0 {
+				last := board.hist[len(board.hist)-1].rule50
+				var ml moveList
+				board.genAllLegals(&ml)
+				board.move(ml[0])
+				board.unmove(ml[0])
+				if board.rule50 != tt.want {
+					t.Errorf("%v: rule50 should be %v after unmove but we got %v", tt.name, tt.want, board.rule50)
+				}
+				if board.hist[len(board.hist)-1].rule50 != last {
+					t.Errorf("%v: history is not restored after unmove", tt.name)
+				}
+			}
+		})
+	}
+}
+
+func Test_isRepetition(t *testing.T) {
+	tests := []struct {
+		name string
+		pos  string
+		ply  int
+		want bool
+	}{
+		{"startpos", "position startpos", 0, false},
+		{"twofold", "position startpos moves g1f3 g8f6 f3g1 f6g8", 0, false},
+		{"threefold", "position startpos moves g1f3 g8f6 f3g1 f6g8 g1f3 g8f6 f3g1 f6g8", 0, true},
+		{"twofold in search", "position startpos moves g1f3 g8f6 f3g1 f6g8", 4, true},
+		{"twofold root in search", "position startpos moves e2e3 g8f6 g1f3 f6g8 f3g1", 4, true},
+		{"twofold before root", "position startpos moves e2e3 g8f6 g1f3 f6g8 f3g1", 2, false},
+		{"pawn move between", "position startpos moves g1f3 g8f6 f3g1 f6g8 e2e4 e7e5 g1f3 g8f6 f3g1 f6g8", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlePosition(tt.pos)
+			if got := board.isRepetition(tt.ply); got != tt.want {
+				t.Errorf("%v: isRepetition(%v) should be %v but we got %v", tt.name, tt.ply, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_pawnAtks(t *testing.T) {
+	positions := []string{
+		"position fen r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+		"position fen rnbq1k1r/pp1Pbppp/2p5/8/2B5/8/PPP1NnPP/RNBQK2R w KQ - 1 8",
+		"position fen 7k/pP4pP/1P4P1/8/8/1p4p1/Pp4pP/K7 w - - 0 1",
+	}
+	// atks returns the squares attacked by a pawn of colour sd on sq
+	atks := func(sq int, sd colour) bitBoard {
+		var bb bitBoard
+		dir := 8
+		if sd == BLACK {
+			dir = -8
+		}
+		if sq%8 != 0 && sq+dir-1 >= 0 && sq+dir-1 < 64 {
+			bb.set(sq + dir - 1)
+		}
+		if sq%8 != 7 && sq+dir+1 >= 0 && sq+dir+1 < 64 {
+			bb.set(sq + dir + 1)
+		}
+		return bb
+	}
+	for _, pos := range positions {
+		handlePosition(pos)
+		var wAtks, bAtks, wAtkers, bAtkers bitBoard
+		for sq := 0; sq < 64; sq++ {
+			switch board.sq[sq] {
+			case wP:
+				wAtks |= atks(sq, WHITE)
+				if atks(sq, WHITE)&board.wbBB[BLACK] != 0 {
+					wAtkers.set(sq)
+				}
+			case bP:
+				bAtks |= atks(sq, BLACK)
+				if atks(sq, BLACK)&board.wbBB[WHITE] != 0 {
+					bAtkers.set(sq)
+				}
+			}
+			if got, want := board.wPawnAtksFr(sq), atks(sq, WHITE)&board.wbBB[BLACK]; got != want {
+				t.Errorf("%v: wPawnAtksFr(%v) should be %x but we got %x", pos, sq2Fen[sq], want, got)
+			}
+			if got, want := board.bPawnAtksFr(sq), atks(sq, BLACK)&board.wbBB[WHITE]; got != want {
+				t.Errorf("%v: bPawnAtksFr(%v) should be %x but we got %x", pos, sq2Fen[sq], want, got)
+			}
+		}
+		if got := board.wPawnAtksBB(); got != wAtks {
+			t.Errorf("%v: wPawnAtksBB should be %x but we got %x", pos, wAtks, got)
+		}
+		if got := board.bPawnAtksBB(); got != bAtks {
+			t.Errorf("%v: bPawnAtksBB should be %x but we got %x", pos, bAtks, got)
+		}
+		if got := board.wPawnAtkers(); got != wAtkers {
+			t.Errorf("%v: wPawnAtkers should be %x but we got %x", pos, wAtkers, got)
+		}
+		if got := board.bPawnAtkers(); got != bAtkers {
+			t.Errorf("%v: bPawnAtkers should be %x but we got %x", pos, bAtkers, got)
+		}
+	}
+}
+
+func Test_FEN(t *testing.T) {
+	tests := []struct {
+		name string
+		pos  string
+		want string
+	}{
+		{"startpos", "position startpos", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1"},
+		{"moves", "position startpos moves e2e4 c7c5 g1f3", "rnbqkbnr/pp1ppppp/8/2p5/4P3/5N2/PPPP1PPP/RNBQKB1R b KQkq - 1 2"},
+		{"ep", "position startpos moves e2e4", "rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 0 1"},
+		{"castled", "position startpos moves e2e4 e7e5 g1f3 g8f6 f1c4 f8c5 e1g1", "rnbqk2r/pppp1ppp/5n2/2b1p3/2B1P3/5N2/PPPP1PPP/RNBQ1RK1 b kq - 5 4"},
+		{"no full move", "position fen 8/8/8/8/8/8/8/K6k b - - 3", "8/8/8/8/8/8/8/K6k b - - 3 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlePosition(tt.pos)
+			if got := board.FEN(); got != tt.want {
+				t.Errorf("%v: FEN should be %#v but we got %#v", tt.name, tt.want, got)
+			}
+		})
+	}
+}
+
+// sameBoard returns true if the two boards have the same position (the history is not compared)
+func sameBoard(b1, b2 *boardStruct) bool {
+	return b1.key == b2.key && b1.sq == b2.sq && b1.wbBB == b2.wbBB && b1.pieceBB == b2.pieceBB &&
+		b1.King == b2.King && b1.ep == b2.ep && b1.castlings == b2.castlings && b1.stm == b2.stm &&
+		b1.count == b2.count && b1.rule50 == b2.rule50 && b1.fullMove == b2.fullMove
+}
+
+func Test_FENRoundTrip(t *testing.T) {
+	fens := []string{
+		"rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1",
+		"r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+		"8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1",
+		"r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1",
+		"r2q1rk1/pP1p2pp/Q4n2/bbp1p3/Np6/1B3NBn/pPPP1PPP/R3K2R b KQ - 0 1",
+		"rnbq1k1r/pp1Pbppp/2p5/8/2B5/8/PPP1NnPP/RNBQK2R w KQ - 1 8",
+		"r4rk1/1pp1qppp/p1np1n2/2b1p1B1/2B1P1b1/P1NP1N2/1PP1QPPP/R4RK1 w - - 0 10",
+	}
+	for _, fen := range fens {
+		handlePosition("position fen " + fen)
+		if got := board.FEN(); got != fen {
+			t.Errorf("FEN should be %#v but we got %#v", fen, got)
+		}
+
+		// all positions after one and two moves
+		var ml moveList
+		board.genAllMoves(&ml)
+		for _, mv := range ml {
+			if !board.move(mv) {
+				continue
+			}
+			var ml2 moveList
+			board.genAllMoves(&ml2)
+			for _, mv2 := range ml2 {
+				if !board.move(mv2) {
+					continue
+				}
+				saved := board
+				parseFEN(board.FEN())
+				if !sameBoard(&saved, &board) {
+					t.Errorf("%v moves %v %v: the board is not the same after parseFEN(FEN()) %v", fen, mv.String(), mv2.String(), saved.FEN())
+				}
+				board = saved
+				board.unmove(mv2)
+			}
+			board.unmove(mv)
+		}
+		if got := board.FEN(); got != fen {
+			t.Errorf("FEN should be %#v after move/unmove but we got %#v", fen, got)
+		}
+	}
+}
+
+func Test_parseFENErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		fen  string
+		want string // part of the error message. "" if no error
+	}{
+		{"ok", "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1", ""},
+		{"ok short", "4k3/8/8/8/8/8/8/4K3 b", ""},
+		{"empty", "", "must have at least"},
+		{"no stm", "4k3/8/8/8/8/8/8/4K3", "must have at least"},
+		{"too many fields", "4k3/8/8/8/8/8/8/4K3 w - - 0 1 x", "too many fields"},
+		{"7 ranks", "4k3/8/8/8/8/8/4K3 w - - 0 1", "must have 8 ranks"},
+		{"rank overflow", "4k3/8/8/8/8/8/8/4K4 w - - 0 1", "rank 1 (4K4) has more than 8 squares"},
+		{"rank overflow pieces", "4k3/8/8/pppppppp1/8/8/8/4K3 w - - 0 1", "rank 5 (pppppppp1) has more than 8 squares"},
+		{"rank underflow", "4k3/8/8/8/7/8/8/4K3 w - - 0 1", "rank 4 (7) has less than 8 squares"},
+		{"bad piece", "4k3/8/8/8/3X4/8/8/4K3 w - - 0 1", "invalid piece 'X'"},
+		{"no white king", "4k3/8/8/8/8/8/8/8 w - - 0 1", "one white and one black king"},
+		{"two black kings", "4k2k/8/8/8/8/8/8/4K3 w - - 0 1", "one white and one black king"},
+		{"pawn on rank 8", "3Pk3/8/8/8/8/8/8/4K3 w - - 0 1", "pawns on the first or last rank"},
+		{"pawn on rank 1", "4k3/8/8/8/8/8/8/p3K3 w - - 0 1", "pawns on the first or last rank"},
+		{"bad stm", "4k3/8/8/8/8/8/8/4K3 x - - 0 1", "side to move \"x\""},
+		{"not stm in check", "4k3/8/8/8/8/8/8/R3K3 b - - 0 1", ""},
+		{"side not to move in check", "4k3/8/8/8/8/8/8/4K2r b - - 0 1", "side not to move is in check"},
+		{"bad castling char", "r3k2r/8/8/8/8/8/8/R3K2R w KX - 0 1", "invalid character 'X'"},
+		{"castling twice", "r3k2r/8/8/8/8/8/8/R3K2R w KK - 0 1", "'K' more than once"},
+		{"castling no rook", "r3k3/8/8/8/8/8/8/R3K2R w KQkq - 0 1", "castling KQkq needs the black rook on h8"},
+		{"castling king moved", "r3k2r/8/8/8/8/8/8/R2K3R w KQ - 0 1", "castling KQ needs the white king on e1"},
+		{"ep", "rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq e6 0 2", ""},
+		{"ep wrong rank", "rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq e3 0 2", "ep square e3 is not possible"},
+		{"ep no pawn", "rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq d6 0 2", "ep square d6 doesn't match"},
+		{"ep bad square", "rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq x9 0 2", "ep square x9"},
+		{"bad rule50", "4k3/8/8/8/8/8/8/4K3 w - - x 1", "50 move rule x"},
+		{"bad full move", "4k3/8/8/8/8/8/8/4K3 w - - 0 0", "full move number 0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := parseFEN(tt.fen)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("%v: %#v should be ok but we got %v", tt.name, tt.fen, err)
+			case tt.want != "" && err == nil:
+				t.Errorf("%v: %#v should give an error", tt.name, tt.fen)
+			case tt.want != "" && !strings.Contains(err.Error(), tt.want):
+				t.Errorf("%v: the error should contain %#v but we got %#v", tt.name, tt.want, err.Error())
+			}
+		})
+	}
+}
+
+func Test_handlePositionKeepsBoard(t *testing.T) {
+	tell = testTell
+	tests := []struct {
+		cmd  string
+		want string // the start of the error told to the GUI
+	}{
+		{"position fen 4k3/8/8/8/8/8/8/8 w - - 0 1", "info string Error"},
+		{"position fen 4k3/8/8/8/8/8/8/4K2r b - - 0 1", "info string Error"},
+		{"position fen", "info string Error"},
+		{"position skit", "info string Error"},
+		{"position startpos moves d2d4 d7d9", "info string d7d9 in the position has an incorrect to square"},
+		{"position startpos moves e2e4 e7e5 e4e5", "info string e4e5 in the position command is an illegal move"},
+		{"position startpos moves e2e4 e7e5 e1g1", "info string e1g1 in the position command is an illegal move"},
+		{"position fen 4k3/8/8/8/8/8/8/r3K3 w - - 0 1 moves e1d1", "info string e1d1 in the position command is an illegal move"},
+		{"position fen 4k3/P7/8/8/8/8/8/4K3 w - - 0 1 moves a7a8k", "info string promotion piece in a7a8k"},
+	}
+	for _, tt := range tests {
+		handlePosition("position startpos moves e2e4 e7e5")
+		want := board.FEN()
+		clearGUI()
+		handlePosition(tt.cmd)
+		if got := board.FEN(); got != want {
+			t.Errorf("%v: the board should be %v but we got %v", tt.cmd, want, got)
+		}
+		lines := guiLines()
+		if len(lines) == 0 || !strings.HasPrefix(lines[len(lines)-1], tt.want) {
+			t.Errorf("%v: should tell %#v but we got %#v", tt.cmd, tt.want, lines)
+		}
+	}
+}
+
+func Test_moveNull(t *testing.T) {
+	debug = true
+	defer func() { debug = false }()
+	tests := []struct {
+		name string
+		pos  string
+	}{
+		{"startpos", "position startpos"},
+		{"ep", "position startpos moves e2e4"},
+		{"rule50", "position startpos moves g1f3 g8f6 f3g1"},
+		{"castlings", "position fen r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R b KQkq - 0 1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlePosition(tt.pos)
+			saved := board
+			histLen := len(board.hist)
+			ep := board.moveNull()
+			if board.stm == saved.stm || board.ep != 0 || board.key == saved.key {
+				t.Errorf("%v: moveNull should change stm and key and clear ep", tt.name)
+			}
+			if !checkKey(&board) {
+				t.Errorf("%v: key=%x but should be %x after moveNull", tt.name, board.key, board.calcKey())
+			}
+			if board.isRepetition(1) {
+				t.Errorf("%v: no repetition over a null move", tt.name)
+			}
+			board.unmoveNull(ep)
+			if !sameBoard(&saved, &board) || len(board.hist) != histLen {
+				t.Errorf("%v: the board is not restored after unmoveNull. %v should be %v", tt.name, board.FEN(), saved.FEN())
+			}
+		})
+	}
+}
+
+func Test_hasPieces(t *testing.T) {
+	tests := []struct {
+		name string
+		pos  string
+		sd   colour
+		want bool
+	}{
+		{"startpos", "position startpos", WHITE, true},
+		{"king and pawns", "position fen 4k3/pppp4/8/8/8/8/4PPPP/4K3 w - - 0 1", WHITE, false},
+		{"black knight", "position fen 4k3/pppp4/5n2/8/8/8/4PPPP/4K3 w - - 0 1", BLACK, true},
+		{"white no pieces", "position fen 4k3/pppp4/5n2/8/8/8/4PPPP/4K3 w - - 0 1", WHITE, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlePosition(tt.pos)
+			if got := board.hasPieces(tt.sd); got != tt.want {
+				t.Errorf("%v: hasPieces(%v) should be %v but we got %v", tt.name, tt.sd, tt.want, got)
+			}
+		})
+	}
+}
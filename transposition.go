@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"math/rand"
+	"sync/atomic"
 )
 
 ////////////////////////////////////////////////////////
@@ -11,8 +12,11 @@ var randPcSq [12 * 64]uint64 // keyvalues for 'pc on sq'
 var randEp [8]uint64         // keyvalues for 8 ep files
 var randCastl [16]uint64     // keyvalues for castling states
 
+// zobristSeed is the seed for the random keys. A saved hash file is only valid with the same keys
+const zobristSeed = 1013
+
 // setup random generator with seed
-var rnd = (*rand.Rand)(rand.New(rand.NewSource(1013))) //usage: rnd.Intn(n) NOTE: n > 0
+var rnd = (*rand.Rand)(rand.New(rand.NewSource(zobristSeed))) //usage: rnd.Intn(n) NOTE: n > 0
 
 // Rand64 creates one 64 bit random number
 func rand64() uint64 {
@@ -38,25 +42,24 @@ func initKeys() {
 	}
 
 	// check that all keys are different
-	fmt.Println("checking all random keys")
 	for pc := 0; pc < 12-1; pc++ {
 		for sq := 0; sq < 64; sq++ {
 			key1 := pcSqKey(pc, sq)
 			for pc2 := pc + 1; pc2 < 12; pc2++ {
 				for sq2 := 0; sq2 < 64; sq2++ {
 					if key1 == pcSqKey(pc2, sq2) {
-						fmt.Printf("pc=%v, sq=%v gives the same key as pc=%v, sq=%v \n", pc, sq, pc2, sq2)
+						tell(fmt.Sprintf("info string pc=%v, sq=%v gives the same key as pc=%v, sq=%v", pc, sq, pc2, sq2))
 					}
 				}
 			}
 			for ep := A3; ep <= H3; ep++ {
 				if key1 == epKey(ep) {
-					fmt.Printf("pc=%v, sq=%v gives the same key as ep=%v \n", pc, sq, ep)
+					tell(fmt.Sprintf("info string pc=%v, sq=%v gives the same key as ep=%v", pc, sq, ep))
 				}
 			}
 			for c := uint(0); c < 16; c++ {
 				if key1 == castlKey(c) {
-					fmt.Printf("pc=%v, sq=%v gives the same key as castl=%v \n", pc, sq, c)
+					tell(fmt.Sprintf("info string pc=%v, sq=%v gives the same key as castl=%v", pc, sq, c))
 				}
 			}
 		}
@@ -66,13 +69,13 @@ func initKeys() {
 		key1 := epKey(ep)
 		for ep2 := ep + 1; ep2 <= H3; ep2++ {
 			if key1 == epKey(ep2) {
-				fmt.Printf("ep=%vgives the same key as ep=%v \n", ep, ep2)
+				tell(fmt.Sprintf("info string ep=%v gives the same key as ep=%v", ep, ep2))
 			}
 		}
 
 		for c := uint(0); c < 16; c++ {
 			if key1 == castlKey(c) {
-				fmt.Printf("ep=%v is the same key as castl=%v \n", ep, c)
+				tell(fmt.Sprintf("info string ep=%v is the same key as castl=%v", ep, c))
 			}
 		}
 	}
@@ -81,7 +84,7 @@ func initKeys() {
 		key1 := castlKey(c)
 		for c2 := c + 1; c2 < 16; c2++ {
 			if key1 == castlKey(c2) {
-				fmt.Printf("castl=%v is the same key as castl=%v \n", c, c2)
+				tell(fmt.Sprintf("info string castl=%v is the same key as castl=%v", c, c2))
 			}
 		}
 
@@ -112,7 +115,8 @@ func castlKey(castling uint) uint64 {
 	return randCastl[castling]
 }
 
-func checkKey(b *boardStruct) bool {
+// calcKey computes the full hash key from scratch
+func (b *boardStruct) calcKey() uint64 {
 	key := uint64(0)
 	for sq, pc := range b.sq {
 		if pc == empty {
@@ -121,56 +125,120 @@ func checkKey(b *boardStruct) bool {
 		key ^= pcSqKey(pc, sq)
 	}
 	if b.stm == BLACK {
-		key = ^key
+		key = flipSide(key)
 	}
+	key ^= epKey(b.ep) ^ castlKey(uint(b.castlings))
+	return key
+}
 
-	if key != b.key {
-		return false
-	}
+// checkKey returns true if the incrementally updated key is the same as a key computed from scratch
+func checkKey(b *boardStruct) bool {
+	return b.key == b.calcKey()
+}
 
-	return true
+// assertKey panics if the key is corrupted. Only used in debug mode
+func assertKey(b *boardStruct, where string) {
+	if !checkKey(b) {
+		panic(fmt.Sprintf("hash key corrupted after %v: key=%x calculated=%x", where, b.key, b.calcKey()))
+	}
 }
 
 ////////////////////////////////////////////////////////
 //////////////////////// TRANS /////////////////////////
-const entrySize = 128 / 8
+const (
+	entrySize     = 128 / 8
+	bucketEntries = 4                         // entries in a bucket
+	bucketSize    = bucketEntries * entrySize // 64 bytes. One cache line
+	ageMask       = 0xff                      // the age is 8 bits in ttData
+)
+
+// transposition table size in MB (the UCI Hash option)
+const (
+	defaultHash = 128
+	minHash     = 16
+	maxHash     = 1024
+)
 
+// ttEntry is packed into two 64 bit words. key is the full key xor data.
+// An entry that is read while another thread writes it has a key and data from two different stores.
+// Then key^data is not the full key of the position and the entry is ignored.
+// Both words are read and written with atomics. Then the race detector is happy
 type ttEntry struct {
-	lock      uint32 // the lock, extra safety
-	move      uint32 // the best move from the search
-	_         uint16 // alignement, not used
-	score     int16  // the score from the search
-	age       uint8  // the age of this entry
-	depth     int8   // the depth that the score is based on
-	scoreType uint8  // the score has this score type
-	_         uint8  // alignement, not used
+	key  uint64 // fullKey ^ data
+	data ttData
+}
+
+// ttData holds everything in an entry except the key
+//
+//	bits  0-23 the move (fr, to, p12, cp and pr). Not ep and castlings. They are taken from the board
+//	bits 24-39 score
+//	bits 40-47 depth
+//	bits 48-55 age
+//	bits 56-57 score type
+type ttData uint64
+
+const (
+	ttMoveMask      = 0xffffff
+	ttScoreShift    = 24
+	ttDepthShift    = 40
+	ttAgeShift      = 48
+	ttScoreTypeShft = 56
+)
+
+func packData(mv move, sc, depth, age, scoreType int) ttData {
+	return ttData(uint64(mv)&ttMoveMask) | ttData(uint16(int16(sc)))<<ttScoreShift |
+		ttData(uint8(int8(depth)))<<ttDepthShift | ttData(uint8(age))<<ttAgeShift | ttData(scoreType&3)<<ttScoreTypeShft
+}
+
+func (d ttData) move() move {
+	return move(d & ttMoveMask)
+}
+func (d ttData) score() int {
+	return int(int16(d >> ttScoreShift))
+}
+func (d ttData) depth() int {
+	return int(int8(d >> ttDepthShift))
+}
+func (d ttData) age() int {
+	return int(uint8(d >> ttAgeShift))
+}
+func (d ttData) scoreType() int {
+	return int(d>>ttScoreTypeShft) & 3
+}
+
+// load reads the entry. It returns ok=false if the entry is not for fullKey (or is torn)
+func (e *ttEntry) load(fullKey uint64) (d ttData, ok bool) {
+	key := atomic.LoadUint64(&e.key)
+	d = ttData(atomic.LoadUint64((*uint64)(&e.data)))
+	return d, key^uint64(d) == fullKey
+}
+
+// save writes the entry
+func (e *ttEntry) save(fullKey uint64, d ttData) {
+	atomic.StoreUint64((*uint64)(&e.data), uint64(d))
+	atomic.StoreUint64(&e.key, fullKey^uint64(d))
 }
 
 // clear one entry
 func (e *ttEntry) clear() {
-	//Obs entry skall vara 16 bytes
-	e.lock = 0
-	e.move = uint32(noMove)
-	// entry.utfyllnad = 0  behövs inte
-	e.score = 0
-	e.age = 0
-	e.depth = -1
-	e.scoreType = 0
-	//entry.tomt = 0   behövs inte
+	e.save(0, packData(noMove, 0, -1, 0, 0))
 }
 
+// ttBucket is the entries that a key can be stored in. A bucket fits in one cache line.
+// The table is a large allocation and starts on a page, so no bucket is split between two cache lines
+type ttBucket [bucketEntries]ttEntry
+
 type transpStruct struct {
 	entries uint // number of entries
-	mask    uint // mask for the index
-	cntUsed int  // The transposition table usage
+	mask    uint // mask for the bucket index
 	age     int  // current age
-	tab     []ttEntry
-	// for health tests
-	cStores int
-	cTried  int
-	cFound  int
-	cPrune  int
-	cBest   int
+	tab     []ttBucket
+	// for health tests. Only counted in debug mode. All threads count, so use atomic
+	cStores int64
+	cTried  int64
+	cFound  int64
+	cPrune  int64
+	cBest   int64
 }
 
 var trans transpStruct
@@ -184,22 +252,22 @@ func (t *transpStruct) new(mB int) error {
 	byteSize := mB << 20
 	bits := sizeToBits(byteSize)
 
-	t.entries = 1 << uint(bits)
-	t.mask = t.entries - 1
+	buckets := uint(1) << bits
+	t.entries = buckets * bucketEntries
+	t.mask = buckets - 1
 
 	t.age = 0
-	t.cntUsed = 0
 
-	t.tab = make([]ttEntry, t.entries, t.entries)
+	t.tab = make([]ttBucket, buckets, buckets)
 	t.clear()
-	tell(fmt.Sprintf("info string allocated %v MB to %v entries", len(t.tab)*entrySize/(1024*1024), t.entries))
+	tell(fmt.Sprintf("info string allocated %v MB to %v entries", len(t.tab)*bucketSize/(1024*1024), t.entries))
 	return nil
 }
 
-// returns how many bits the mask will need to cover the table size
+// returns how many bits the mask will need to cover the table size with buckets
 func sizeToBits(size int) uint {
 	bits := uint(0)
-	for cntEntries := size / entrySize; cntEntries > 1; cntEntries /= 2 {
+	for cntBuckets := size / bucketSize; cntBuckets > 1; cntBuckets /= 2 {
 		bits++
 	}
 
@@ -211,147 +279,162 @@ func (t *transpStruct) clear() {
 	var e ttEntry
 	e.clear()
 
-	for i := uint(0); i < t.entries; i++ {
-		t.tab[i] = e
+	for i := range t.tab {
+		for j := range t.tab[i] {
+			t.tab[i][j] = e
+		}
 	}
 
 	t.age = 0
-	t.cntUsed = 0
 
 	//counts
 	t.cFound, t.cStores, t.cTried, t.cPrune, t.cBest = 0, 0, 0, 0, 0
 }
 
-// index uses the Key to compute an index into the table
-func (t *transpStruct) index(fullKey uint64) int64 {
-	return int64(fullKey)
+// index uses the Key to compute the bucket index into the table
+func (t *transpStruct) index(fullKey uint64) uint64 {
+	return fullKey & uint64(t.mask)
 }
 
-// Lock extracts the lock value from the hash key
-func (t *transpStruct) lock(fullKey uint64) uint32 {
-	return uint32(fullKey >> 32)
+// count increments a health counter in debug mode
+func (t *transpStruct) count(cnt *int64) {
+	if debug {
+		atomic.AddInt64(cnt, 1)
+	}
 }
 
-//
+// initSearch starts a new age. The entries from the earlier searches become easier to replace
 func (t *transpStruct) initSearch() {
 	t.incAge()
-	t.cntUsed = 0
 
 	// Health check counts
 	t.cFound, t.cStores, t.cTried, t.cPrune, t.cBest = 0, 0, 0, 0, 0
 }
 
 // incAge increments the date for the hahs table.
-// We are reborned after the age 255
+// We are reborned after the age 255. relAge handles the wraparound
 func (t *transpStruct) incAge() {
-	t.age = (t.age + 1) % 256
+	t.age = (t.age + 1) & ageMask
+}
+
+// relAge returns how many searches ago an entry with age was stored. 0 is the current search.
+// An entry stored at age 255 is 1 search old at age 0
+func (t *transpStruct) relAge(age int) int {
+	return (t.age - age) & ageMask
 }
 
+// hashfull returns the permille of the table that is used by the current search.
+// It looks at the first 1000 entries like most engines do
+func (t *transpStruct) hashfull() int {
+	cnt, used := 0, 0
+	for i := 0; i < len(t.tab) && cnt < 1000; i++ {
+		for j := range t.tab[i] {
+			d := ttData(atomic.LoadUint64((*uint64)(&t.tab[i][j].data)))
+			if d.depth() >= 0 && d.age() == t.age {
+				used++
+			}
+			cnt++
+		}
+	}
+	if cnt == 0 {
+		return 0
+	}
+	return used * 1000 / cnt
+}
+
+// fullKey returns the hash key for the position. The ep and castling states are already included
 func (b *boardStruct) fullKey() uint64 {
-	key := b.key ^ epKey(b.ep)
-	key ^= castlKey(uint(b.castlings))
-	return key
+	return b.key
+}
+
+// ttMove returns the move from the transposition table with ep and castlings from the board
+func (b *boardStruct) ttMove(mv move) move {
+	if mv == noMove {
+		return noMove
+	}
+	mv.packMove(mv.fr(), mv.to(), mv.p12(), mv.cp(), mv.pr(), b.ep, b.castlings)
+	return mv
 }
 
 // store current position in the transp table.
-// The key is computed from the position. The lock value is the 32 first bits in the key
-// From the key we get an index to the table.
-// We will try 4 entries in a sequence if a lock is found
-// We always try to replace another age and/or a lower searched depth
+// The key is computed from the position. The whole key is used to verify the entry
+// From the key we get the bucket. If the key is found in the bucket the entry is updated.
+// Otherwise we replace the victim entry
 
 func (t *transpStruct) store(fullKey uint64, mv move, depth, ply, sc, scoreType int) {
 
-	t.cStores++
+	t.count(&t.cStores)
 	sc = removeMatePly(sc, ply)
 
-	index := fullKey & uint64(t.mask)
-	lock := t.lock(fullKey)
-
-	var newEntry *ttEntry
-	bestDep := -2000
-
-	for i := uint64(0); i < 4; i++ {
-		idx := (uint64(index) + i) & uint64(t.mask)
-
-		entry := &t.tab[idx]
+	bucket := &t.tab[t.index(fullKey)]
 
-		if entry.lock == lock {
-			if int(entry.age) != t.age {
-				entry.age = uint8(t.age)
-				t.cntUsed++
-			}
-
-			if depth >= int(entry.depth) {
-				if mv != noMove {
-					entry.move = uint32(mv.onlyMv())
+	for i := range bucket {
+		entry := &bucket[i]
+		d, ok := entry.load(fullKey)
+		if ok {
+			if depth >= d.depth() || d.age() != t.age {
+				if mv == noMove {
+					mv = d.move()
 				}
-				entry.depth = int8(depth)
-				entry.score = int16(sc)
-				entry.scoreType = uint8(scoreType)
+				entry.save(fullKey, packData(mv, sc, depth, t.age, scoreType))
 				return
 			}
 
-			if entry.move == uint32(noMove) {
-				entry.move = uint32(mv.onlyMv())
+			if d.move() == noMove {
+				entry.save(fullKey, packData(mv, d.score(), d.depth(), t.age, d.scoreType()))
 			}
-
 			return
 		}
+	}
 
-		adjDepth := -int(entry.depth)
-		if entry.age != uint8(t.age) {
-			adjDepth += 1000 // make age more important than depth
-		}
+	t.victim(bucket).save(fullKey, packData(mv, sc, depth, t.age, scoreType))
+}
 
-		if adjDepth > bestDep {
-			newEntry = entry
-			bestDep = adjDepth
+// victim returns the entry in the bucket to replace. An empty entry or the entry with the lowest depth.
+// Old entries lose 8 plies of depth per age
+func (t *transpStruct) victim(bucket *ttBucket) *ttEntry {
+	var replace *ttEntry
+	worst := 0
+	for i := range bucket {
+		d := ttData(atomic.LoadUint64((*uint64)(&bucket[i].data)))
+		v := d.depth() - 8*t.relAge(d.age())
+		if d.depth() < 0 { // empty
+			v = minEval
+		}
+		if replace == nil || v < worst {
+			replace, worst = &bucket[i], v
 		}
 	}
-
-	if newEntry.age != uint8(t.age) {
-		t.cntUsed++
-	}
-
-	newEntry.lock = lock
-	newEntry.age = uint8(t.age)
-	newEntry.depth = int8(depth)
-	newEntry.move = uint32(mv)
-	newEntry.score = int16(sc)
-	newEntry.scoreType = uint8(scoreType)
+	return replace
 }
 
-// retrieve get move and score to the current position from the transp Table if the key and lock is correct
+// retrieve get move and score to the current position from the transp Table if the key is correct
 // if no entry is matching return false else return true, depth not ok return false but with move filled in
-// We will try the 4 entries in sequence until lock match otherwise return false
+// We will try the entries in the bucket until the key match otherwise return false
+// The move has no ep and castlings. Use b.ttMove to get them from the board
 func (t *transpStruct) retrieve(fullKey uint64, depth, ply int) (mv move, sc, scoreType int, ok bool) {
-	t.cTried++
+	t.count(&t.cTried)
 	mv = noMove
 	ok = false
 	sc = noScore
 	scoreType = 0
 
-	index := fullKey & uint64(t.mask)
-	lock := t.lock(fullKey)
+	bucket := &t.tab[t.index(fullKey)]
 
-	for i := uint64(0); i < 4; i++ {
+	for i := range bucket {
+		entry := &bucket[i]
 
-		idx := uint(index+i) & t.mask
-		entry := &t.tab[idx]
+		if d, found := entry.load(fullKey); found { // there is a matching position already here
+			t.count(&t.cFound)
 
-		if entry.lock == lock { // there is a matching position already here
-			t.cFound++
-
-			if int(entry.age) != t.age { // from another generation?
-				entry.age = uint8(t.age)
-				t.cntUsed++
+			if d.age() != t.age { // from another generation? It is still useful
+				entry.save(fullKey, packData(d.move(), d.score(), d.depth(), t.age, d.scoreType()))
 			}
-			mv = move(entry.move)
-			sc = addMatePly(int(entry.score), ply)
-			scoreType = int(entry.scoreType)
+			mv = d.move()
+			sc = addMatePly(d.score(), ply)
+			scoreType = d.scoreType()
 			ok = true
-			if int(entry.depth) >= depth {
-				//				fmt.Println("retrieve (key,depth,ply)",fullKey,depth,ply,"(mv,sc,scTyp):", mv, sc, scoreType)
+			if d.depth() >= depth {
 				return
 			}
 
@@ -360,15 +443,12 @@ func (t *transpStruct) retrieve(fullKey uint64, depth, ply int) (mv move, sc, sc
 				if sc < 0 {
 					scoreType &= ^scoreTypeLower
 				}
-				//				fmt.Println("retrieve (key,depth,ply)",fullKey,depth,ply,"(mv,sc,scTyp):", mv, sc, scoreType)
 				return
 			}
-			//			fmt.Println("Nothing to retrieve-depth? (key,depth,ply):", fullKey, depth,ply)
 			ok = false
 			return
 		}
 	}
-	//	fmt.Println("Nothing to retrieve - no hit (key,depth,ply):", fullKey, depth,ply)
 	ok = false
 	return
 }
@@ -378,24 +458,36 @@ func isMateScore(sc int) bool {
 	return sc < minEval+maxPly || sc > maxEval-maxPly
 }
 
-// removeMatePly removes ply from the score value (score - ply) if mate
+// mateIn returns the number of moves to mate. It is > 0 if we are mating, < 0 if we are mated
+// and 0 if sc is not a mate score
+func mateIn(sc int) int {
+	if sc > maxEval-maxPly {
+		return (mateEval - sc + 1) / 2
+	}
+	if sc < minEval+maxPly {
+		return -(mateEval + sc) / 2
+	}
+	return 0
+}
+
+// removeMatePly converts a mate score from distance to root to distance to the current position
 // in order to mix up different depths
 func removeMatePly(sc, ply int) int {
 	if sc < minEval+maxPly {
-		return -mateEval
+		return sc - ply
 	} else if sc > maxEval-maxPly {
-		return mateEval
+		return sc + ply
 	} else {
 		return sc
 	}
 }
 
-// addMatePly adjusts mate value with ply if mate score
+// addMatePly adjusts mate value with ply if mate score (back to distance to root)
 func addMatePly(sc, ply int) int {
 	if sc < minEval+maxPly {
-		return -mateEval + ply
+		return sc + ply
 	} else if sc > maxEval-maxPly {
-		return mateEval - ply
+		return sc - ply
 	}
 	return sc
 }
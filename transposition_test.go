@@ -0,0 +1,262 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func Test_checkKey(t *testing.T) {
+	tests := []struct {
+		name string
+		pos  string
+	}{
+		{"startpos", "position startpos"},
+		{"black to move", "position startpos moves e2e4"},
+		{"castlings", "position startpos moves e2e4 e7e5 g1f3 g8f6 f1c4 f8c5 e1g1 e8g8"},
+		{"long castlings", "position startpos moves d2d4 d7d5 b1c3 b8c6 c1f4 c8f5 d1d2 d8d7 e1c1 e8c8"},
+		{"ep", "position fen rnbqkbnr/1ppp1p2/4p1pp/pP5P/8/8/P1PPPPP1/RNBQKBNR w KQkq a6 0 5 moves b5a6"},
+		{"promotion", "position fen r1n5/1PPP2P1/8/8/7p/4k2P/1p2p1P1/1N2K3 w - - 0 47 moves b7a8q b2a1n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlePosition(tt.pos)
+			if !checkKey(&board) {
+				t.Errorf("%v: key=%x but should be %x", tt.name, board.key, board.calcKey())
+			}
+		})
+	}
+}
+
+func Test_keyTransposition(t *testing.T) {
+	tests := []struct {
+		name string
+		pos1 string
+		pos2 string
+		same bool
+	}{
+		{"move order", "position startpos moves g1f3 g8f6 b1c3", "position startpos moves b1c3 g8f6 g1f3", true},
+		{"fen vs moves", "position startpos moves e2e4 e7e5", "position fen rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq e6 0 2", true},
+		{"side to move", "position startpos", "position fen rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR b KQkq - 0 1", false},
+		{"ep", "position startpos moves e2e4", "position fen rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq - 0 1", false},
+		{"castlings", "position startpos moves g1f3 g8f6 h1g1 h8g8 g1h1 g8h8", "position startpos moves g1f3 g8f6 f3g1 f6g8", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handlePosition(tt.pos1)
+			key1 := board.fullKey()
+			handlePosition(tt.pos2)
+			key2 := board.fullKey()
+			if (key1 == key2) != tt.same {
+				t.Errorf("%v: key1=%x key2=%x. same should be %v", tt.name, key1, key2, tt.same)
+			}
+		})
+	}
+}
+
+func Test_keyMoveUnmove(t *testing.T) {
+	debug = true
+	defer func() { debug = false }()
+	positions := []string{
+		"position startpos",
+		"position startpos moves e2e4 d7d5",
+		"position fen r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1",
+		"position fen rnbqkbnr/1ppp1p2/4p1pp/pP5P/8/8/P1PPPPP1/RNBQKBNR w KQkq a6 0 5",
+		"position fen 8/1PPP2P1/8/6K1/8/4k3/pppp2p1/BNR5 b - - 0 47",
+	}
+	for _, pos := range positions {
+		handlePosition(pos)
+		key := board.key
+		var ml moveList
+		board.genAllMoves(&ml)
+		for _, mv := range ml {
+			if board.move(mv) {
+				board.unmove(mv)
+			}
+			if board.key != key {
+				t.Errorf("%v: key not restored after move/unmove %v", pos, mv.String())
+			}
+		}
+	}
+}
+
+func Test_ttData(t *testing.T) {
+	var mv move
+	mv.packMove(E7, E8, wP, empty, wQ, 0, 0)
+	tests := []struct {
+		name      string
+		mv        move
+		sc        int
+		depth     int
+		age       int
+		scoreType int
+	}{
+		{"promotion", mv, 950, 12, 3, scoreTypeBetween},
+		{"negative score", mv, -123, 1, 255, scoreTypeUpper},
+		{"mated", noMove, -mateEval + 3, 0, 0, scoreTypeLower},
+		{"mating", mv, mateEval - 7, 99, 128, scoreTypeLower},
+		{"no depth", noMove, 0, -1, 17, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := packData(tt.mv, tt.sc, tt.depth, tt.age, tt.scoreType)
+			if d.move() != tt.mv || d.score() != tt.sc || d.depth() != tt.depth || d.age() != tt.age || d.scoreType() != tt.scoreType {
+				t.Errorf("%v: got %v %v %v %v %v", tt.name, d.move().String(), d.score(), d.depth(), d.age(), d.scoreType())
+			}
+		})
+	}
+}
+
+// Test_ttTorn checks that an entry with the key from one store and the data from another is not found
+func Test_ttTorn(t *testing.T) {
+	var e1, e2 ttEntry
+	e1.save(0x1234567812345678, packData(noMove, 10, 5, 1, scoreTypeBetween))
+	e2.save(0x8765432187654321, packData(noMove, -10, 6, 1, scoreTypeLower))
+	if _, ok := e1.load(0x1234567812345678); !ok {
+		t.Errorf("e1 should be found")
+	}
+	torn := ttEntry{key: e1.key, data: e2.data}
+	if _, ok := torn.load(0x1234567812345678); ok {
+		t.Errorf("a torn entry should not be found with the first key")
+	}
+	if _, ok := torn.load(0x8765432187654321); ok {
+		t.Errorf("a torn entry should not be found with the second key")
+	}
+}
+
+// Test_ttRace stores and retrieves the same few entries from many goroutines. Run it with go test -race.
+// All keys share 4 buckets. A retrieved entry must always have the data that was stored with its key.
+// The health counters are on (debug) and must not lose any count
+func Test_ttRace(t *testing.T) {
+	tell = testTell
+	debug = true
+	defer func() { debug = false }()
+	var tt transpStruct
+	if err := tt.new(minHash); err != nil {
+		t.Fatal(err)
+	}
+	const goroutines, keys, loops = 8, 64, 20000
+	keyOf := func(i int) uint64 { return uint64(i+1)<<32 | uint64(i%4) }
+	dataOf := func(i int) (move, int, int) {
+		var mv move
+		mv.packMove(i%64, (i+9)%64, wN, empty, empty, 0, 0)
+		return mv, i*37 - 1000, 1 + i%20
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < loops; n++ {
+				i := (n*7 + g*13) % keys
+				mv, sc, depth := dataOf(i)
+				if (n+g)%2 == 0 {
+					tt.store(keyOf(i), mv, depth, 0, sc, scoreTypeBetween)
+					continue
+				}
+				gotMv, gotSc, gotType, ok := tt.retrieve(keyOf(i), 0, 0)
+				if ok && (gotMv != mv || gotSc != sc || gotType != scoreTypeBetween) {
+					t.Errorf("key %x: got %v %v %v but want %v %v %v", keyOf(i), gotMv.String(), gotSc, gotType, mv.String(), sc, scoreTypeBetween)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if tt.cStores != goroutines*loops/2 || tt.cTried != goroutines*loops/2 {
+		t.Errorf("the counters should be %v stores and %v tries but we got %v and %v", goroutines*loops/2, goroutines*loops/2, tt.cStores, tt.cTried)
+	}
+}
+
+// Test_ttReplace fills a bucket and checks which entry a new key replaces.
+// ageBack is how many searches ago the entry was stored. The current age is 1, so 2 searches ago is age 255
+func Test_ttReplace(t *testing.T) {
+	tell = testTell
+	var tt transpStruct
+	if err := tt.new(minHash); err != nil {
+		t.Fatal(err)
+	}
+	keyOf := func(i int) uint64 { return uint64(i+1)<<40 | 7 } // all in bucket 7
+	tests := []struct {
+		name     string
+		depths   [bucketEntries]int
+		ageBack  [bucketEntries]int
+		replaced int
+	}{
+		{"lowest depth", [4]int{5, 3, 7, 6}, [4]int{0, 0, 0, 0}, 1},
+		{"old entry", [4]int{5, 3, 7, 6}, [4]int{0, 0, 1, 0}, 2},
+		{"deep old entry", [4]int{12, 2, 9, 6}, [4]int{1, 0, 0, 0}, 1},
+		{"wraparound", [4]int{4, 4, 4, 4}, [4]int{1, 2, 3, 0}, 2},
+		{"empty entry", [4]int{4, 4, 4, 0}, [4]int{0, 0, 0, 0}, 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tt.clear()
+			stored := bucketEntries
+			if tc.name == "empty entry" {
+				stored-- // the last entry is never stored
+			}
+			for back := 3; back >= 0; back-- { // the oldest first
+				tt.age = (1 - back) & ageMask
+				for i := 0; i < stored; i++ {
+					if tc.ageBack[i] == back {
+						tt.store(keyOf(i), noMove, tc.depths[i], 0, 0, scoreTypeBetween)
+					}
+				}
+			}
+			tt.age = 1
+			tt.store(keyOf(99), noMove, 1, 0, 0, scoreTypeBetween)
+			for i := 0; i < stored; i++ {
+				_, _, _, ok := tt.retrieve(keyOf(i), 0, 0)
+				if ok == (i == tc.replaced) {
+					t.Errorf("%v: entry %v found=%v but entry %v should be replaced", tc.name, i, ok, tc.replaced)
+				}
+			}
+			if _, _, _, ok := tt.retrieve(keyOf(99), 0, 0); !ok {
+				t.Errorf("%v: the new entry is not found", tc.name)
+			}
+		})
+	}
+}
+
+func Test_incAge(t *testing.T) {
+	var tt transpStruct
+	tt.age = 254
+	tt.incAge()
+	if tt.age != 255 || tt.relAge(254) != 1 {
+		t.Errorf("age %v relAge(254) %v should be 255 and 1", tt.age, tt.relAge(254))
+	}
+	tt.incAge()
+	if tt.age != 0 {
+		t.Errorf("age after 255 should be 0 but is %v", tt.age)
+	}
+	if tt.relAge(0) != 0 || tt.relAge(255) != 1 || tt.relAge(254) != 2 {
+		t.Errorf("relAge at age 0 should be 0, 1, 2 but is %v, %v, %v", tt.relAge(0), tt.relAge(255), tt.relAge(254))
+	}
+}
+
+func Test_hashfull(t *testing.T) {
+	tell = testTell
+	var tt transpStruct
+	if err := tt.new(minHash); err != nil {
+		t.Fatal(err)
+	}
+	tt.initSearch()
+	if got := tt.hashfull(); got != 0 {
+		t.Errorf("an empty table should have hashfull 0 but got %v", got)
+	}
+	for i := 0; i < 125; i++ { // one entry in each of the first 125 buckets (500 entries)
+		tt.store(uint64(i)|1<<40, noMove, 3, 0, 0, scoreTypeBetween)
+	}
+	if got := tt.hashfull(); got != 125 {
+		t.Errorf("hashfull should be 125 but got %v", got)
+	}
+	tt.initSearch()
+	if got := tt.hashfull(); got != 0 {
+		t.Errorf("hashfull should be 0 for a new search but got %v", got)
+	}
+	tt.store(1|1<<40, noMove, 3, 0, 0, scoreTypeBetween)
+	if got := tt.hashfull(); got != 1 {
+		t.Errorf("hashfull should be 1 after one store in the new search but got %v", got)
+	}
+}
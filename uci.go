@@ -7,6 +7,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 var (
@@ -15,7 +17,9 @@ var (
 	low   = strings.ToLower
 	split = strings.Split
 
-	saveBm = ""
+	saveBm    = ""
+	debug     = false // set by the gui with "debug on/off". Turns on extra (slow) checks in the engine
+	searching = false // true from go until the engine has sent its best move. Only used by the uci goroutine
 )
 
 func uci(input chan string) {
@@ -28,6 +32,7 @@ func uci(input chan string) {
 		select {
 		case cmd = <-input:
 		case bm = <-frEng:
+			searching = false
 			handleBm(bm)
 			continue
 		}
@@ -54,12 +59,20 @@ func uci(input chan string) {
 			handleSetoption(words)
 		case "stop":
 			handleStop()
+		case "bench":
+			handleBench(toEng, frEng, words)
+		case "savehash":
+			handleSaveHash(words)
+		case "loadhash":
+			handleLoadHash(words)
 		case "quit", "q":
 			handleQuit()
 			quit = true
 			continue
 		case "pb":
 			board.Print()
+		case "pf", "d":
+			fmt.Println(board.FEN())
 		case "pbb":
 			board.printAllBB()
 		case "pm":
@@ -79,8 +92,12 @@ func uci(input chan string) {
 				continue
 			}
 			fmt.Println("see = ", see(fr, to, &board))
+		case "perft", "divide":
+			handlePerft(words)
 		case "pqs":
 			fmt.Println("qs =", qs(maxEval, &board))
+		default:
+			tell("info string unknown cmd ", cmd)
 		}
 	}
 	tell("info string leaving uci(")
@@ -90,16 +107,41 @@ func handleUci() {
 	tell("id name GoBit")
 	tell("id author Carokanns")
 
-	tell("option name Hash type spin default 128 min 16 max 1024")
-	tell("option name Threads type spin default 1 min 1 max 16")
+	for _, o := range options {
+		tell(o.String())
+	}
 	tell("uciok")
 }
 
 func handleIsReady() {
 	tell("readyok")
 }
-func handleSetoption(option []string) {
-	tell("info string not implemented yet")
+
+// handleSetoption parses the setoption command and applies the option
+func handleSetoption(words []string) {
+	// setoption name <id> [value <x>]
+	name, value := "", ""
+	inValue := false
+	for _, w := range words[1:] {
+		switch {
+		case low(w) == "name" && name == "":
+		case low(w) == "value" && !inValue:
+			inValue = true
+		case inValue:
+			value = trim(value + " " + w)
+		default:
+			name = trim(name + " " + w)
+		}
+	}
+
+	o := findOption(name)
+	if o == nil {
+		tell("info string unknown option ", name)
+		return
+	}
+	if err := o.set(value); err != nil {
+		tell("info string ", err.Error())
+	}
 }
 
 func handleNewgame() {
@@ -107,7 +149,7 @@ func handleNewgame() {
 }
 func handlePosition(cmd string) {
 	// position [fen <fenstring> | startpos ] moves <move1> .... <movei>
-	board.newGame()
+	// the board is not changed if the command, the fen string or one of the moves is not correct
 	cmd = trim(strings.TrimPrefix(cmd, "position"))
 	parts := split(cmd, "moves")
 
@@ -132,80 +174,164 @@ func handlePosition(cmd string) {
 	}
 	// Now parts[0] is the fen-string only
 
-	// start the parsing
-
-	parseFEN(parts[0])
+	// the fen and all moves are parsed on a new board. board is only changed if everything is correct
+	b, err := fenToBoard(parts[0])
+	if err != nil {
+		tell("info string Error ", err.Error())
+		return
+	}
 
 	if len(parts) == 2 {
-		parts[1] = low(trim(parts[1]))
-		fmt.Printf("info string parse %#v\n", parts[1])
-		parseMvs(parts[1])
+		if err := b.parseMvs(trim(parts[1])); err != nil {
+			tell("info string ", err.Error())
+			return
+		}
 	}
-
+	board = b
 }
 
 // handleGo parses the go command. The go command tells us to start thinking about best moves.
-func handleGo(toEng chan bool, words []string) {
-	// go searchmoves <move1-moveii>/ponder/wtime <ms>/ btime <ms>/winc/bi
+func handleGo(toEng chan searchLimits, words []string) {
+	// go searchmoves <move1-moveii>/ponder/wtime <ms>/ btime <ms>/winc/binc/movestogo/depth/nodes/mate/movetime/infinite
 	limits.init()
+	saveBm = ""
 
-	if len(words) > 1 {
-		words[1] = trim(low(words[1]))
-		switch words[1] {
+	for ix := 1; ix < len(words); ix++ {
+		word := trim(low(words[ix]))
+		switch word {
 		case "searchmoves":
-			tell("info string go searchmoves not implemented")
+			for ix+1 < len(words) && isUciMove(words[ix+1]) {
+				ix++
+				limits.searchMoves = append(limits.searchMoves, low(words[ix]))
+			}
 		case "ponder":
-			tell("info string go ponder not implemented")
-		case "wtime":
-			tell("info string go wtime not implemented")
-		case "btime":
-			tell("info string go btime not implemented")
-		case "winc":
-			tell("info string go winc not implemented")
-		case "binc":
-			tell("info string go binc not implemented")
-		case "movestogo":
-			tell("info string go movestogo not implemented")
-		case "depth":
-			d, err := strconv.Atoi(words[2])
-			if err != nil {
-				tell("info string ", words[2], " not numeric")
+			limits.ponder = true
+		case "infinite":
+			limits.setInfinite(true)
+		case "wtime", "btime", "winc", "binc", "movestogo", "depth", "nodes", "mate", "movetime":
+			if ix+1 >= len(words) {
+				tell("info string go ", word, " needs a value")
 				return
 			}
-			limits.setDepth(d)
-			toEng <- true
-		case "nodes":
-			tell("info string go nodes not implemented")
-		case "movetime":
-			mt, err := strconv.Atoi(words[2])
-			if err != nil {
-				tell("info string ", words[2], " not numeric")
+			ix++
+			val, err := strconv.Atoi(words[ix])
+			if err != nil || (val < 0 && word != "wtime" && word != "btime") {
+				tell("info string go ", word, " ", words[ix], " is not a valid number")
 				return
 			}
-			limits.setMoveTime(mt)
-			toEng <- true
-		case "mate": // mate <x> mate in x moves
-			tell("info string go mate not implemented")
-		case "infinite":
-			limits.setInfinite(true)
-			toEng <- true
-		case "register":
-			tell("info string go register not implemented")
+			switch word {
+			case "wtime":
+				limits.wTime = max(val, 0)
+			case "btime":
+				limits.bTime = max(val, 0)
+			case "winc":
+				limits.wInc = val
+			case "binc":
+				limits.bInc = val
+			case "movestogo":
+				limits.movesToGo = val
+			case "depth":
+				limits.setDepth(val)
+			case "nodes":
+				limits.nodes = uint64(val)
+			case "mate": // mate <x> mate in x moves
+				if val < 1 {
+					tell("info string go mate ", words[ix], " must be at least 1")
+					return
+				}
+				limits.mate = val
+				limits.setDepth(2 * val) // the mated side must be searched to find out that it has no moves
+			case "movetime":
+				limits.setMoveTime(val)
+			}
 		default:
-			tell("info string", words[1], " not implemented")
+			tell("info string go ", word, " not implemented")
 		}
-	} else {
-		tell("info string go not implemented")
 	}
+
+	if len(limits.searchMoves) > 0 {
+		limits.searchMoves = legalSearchMoves(limits.searchMoves)
+	}
+
+	if len(words) == 1 {
+		limits.setInfinite(true) // just go
+	}
+	limits.setTimeLimits(board.stm, findOption("Move Overhead").spin())
+	toEng <- limits
+	searching = true
+}
+
+// legalSearchMoves returns the searchmoves that are legal in the current position
+func legalSearchMoves(mvs []string) []string {
+	var ml moveList
+	board.genAllLegals(&ml)
+	legals := mvs[:0]
+	for _, s := range mvs {
+		found := false
+		for _, mv := range ml {
+			if mv.String() == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			tell("info string searchmoves ", s, " is not a legal move")
+			continue
+		}
+		legals = append(legals, s)
+	}
+	if len(legals) == 0 {
+		tell("info string no legal searchmoves. All moves are searched")
+	}
+	return legals
 }
 
+// isUciMove returns true if the string looks like a move in uci format (e2e4, e7e8q)
+func isUciMove(s string) bool {
+	s = low(trim(s))
+	if len(s) != 4 && len(s) != 5 {
+		return false
+	}
+	if _, ok := fenSq2Int[s[:2]]; !ok {
+		return false
+	}
+	if _, ok := fenSq2Int[s[2:4]]; !ok {
+		return false
+	}
+	return len(s) == 4 || strings.ContainsAny(s[4:], "qrbn")
+}
+
+// handlePonderhit handles ponderhit. The opponent played the expected move and the ponder search
+// continues as a normal search with the time limits from the go ponder command
 func handlePonderhit() {
-	tell("info string ponderhit not implemented")
+	if !limits.pondering() {
+		tell("info string ponderhit without go ponder")
+		return
+	}
+	// our clock starts now. The search only reads ponderhitTime, so it doesn't race with us
+	atomic.StoreInt64(&ponderhitTime, time.Now().UnixNano())
+	if saveBm != "" && !limits.infinite { // the search is already done
+		tell(saveBm)
+		saveBm = ""
+	}
 }
 
 func handleDebug(words []string) {
 	// debug [ on | off]
-	tell("info string debug not implemented")
+	if len(words) < 2 {
+		tell("info string debug is ", strconv.FormatBool(debug))
+		return
+	}
+	switch trim(low(words[1])) {
+	case "on":
+		debug = true
+	case "off":
+		debug = false
+	default:
+		tell("info string debug ", words[1], " must be on or off")
+		return
+	}
+	tell("info string debug is ", strconv.FormatBool(debug))
 }
 
 func handleRegister(words []string) {
@@ -215,7 +341,7 @@ func handleRegister(words []string) {
 
 // handleBm handles best move provided from the engine
 func handleBm(bm string) {
-	if limits.infinite {
+	if limits.infinite || limits.pondering() { // wait for stop or ponderhit
 		saveBm = bm
 		return
 	}
@@ -227,14 +353,15 @@ func handleStop() {
 	// if bInfinite the engine is thnking of a best move
 	// if we have a saved best move the engine has done it's job, and can be told to stop
 	// the gui is then told the best move
-	if limits.infinite {
+	if limits.infinite || limits.pondering() {
 		if saveBm != "" {
 			tell(saveBm)
 			saveBm = ""
 		}
 	}
-	limits.setStop(true)
+	searchStop.set(true)
 	limits.setInfinite(false)
+	limits.setPonder(false)
 }
 
 // not really necessary
@@ -2,11 +2,17 @@
 package main
 
 import (
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
-var all2GUI []string
+var (
+	all2GUI   []string
+	all2GUIMu sync.Mutex // the uci and engine goroutines tell while the test reads the lines
+)
 
 func testTell(text ...string) {
 	theCmd := ""
@@ -14,67 +20,112 @@ func testTell(text ...string) {
 		_ = ix
 		theCmd += txt
 	}
+	all2GUIMu.Lock()
 	all2GUI = append(all2GUI, theCmd)
+	all2GUIMu.Unlock()
+}
+
+// guiLines returns a copy of the lines sent to the GUI
+func guiLines() []string {
+	all2GUIMu.Lock()
+	defer all2GUIMu.Unlock()
+	return append([]string(nil), all2GUI...)
+}
+
+// clearGUI forgets the lines sent to the GUI
+func clearGUI() {
+	all2GUIMu.Lock()
+	all2GUI = []string{}
+	all2GUIMu.Unlock()
 }
 
 func Test_Uci(t *testing.T) {
 	tell = testTell
 	input := make(chan string)
 	go uci(input) // if not 'go' we be blocked here
+	waitForGUI(1) // "info string Hello from uci"
 
 	tests := []struct {
 		name   string
 		cmd    string
 		wanted []string
 	}{
-		{"uci", "uci", []string{"id name GoBit", "id author Carokanns", "option name Hash type spin default", "option name Threads type spin default", "uciok"}},
+		{"uci", "uci", []string{"id name GoBit", "id author Carokanns", "option name Hash type spin default", "option name Clear Hash type button", "option name Threads type spin default", "option name Ponder type check default false", "uciok"}},
 		{"isready", "isready", []string{"readyok"}},
-		{"set Hash", "setoption name Hash value 256", []string{"info string setoption not implemented"}},
+		{"set Hash", "setoption name Hash value 32", []string{"info string allocated 32 MB to 2097152 entries"}},
+		{"set Hash too big", "setoption name Hash value 100000", []string{"info string Hash value 100000 must be a number between 16 and 1024"}},
+		{"clear Hash", "setoption name Clear Hash", []string{"info string Hash cleared"}},
+		{"set Threads", "setoption name Threads value 17", []string{"info string Threads value 17 must be a number between 1 and 16"}},
+		{"set unknown", "setoption name Skit value 1", []string{"info string unknown option Skit"}},
 		{"skit", "skit", []string{"info string unknown cmd skit"}},
-		{"pos skit", "position skit", []string{"info string Error\"skit\" must be \"fen\" or \"startpos\""}},
-		{"position no cmd", "position", []string{"info string Error[] wrong length=1"}},
+		{"pos skit", "position skit", []string{"info string Error \"skit\" must be \"fen\" or \"startpos\""}},
+		{"position no cmd", "position", []string{"info string Error [] wrong length=1"}},
 		{"pos incorrect move 1", "position startpos moves e2j4", []string{"info string e2j4 in the position has an incorrect to square"}},
 		{"pos incorrect move 2", "position startpos moves e3e4", []string{"info string e3e4 in the position command. fr_sq is an empty square"}},
-	//	{"pos incorrect move 3", "position startpos moves e2e4 e7e5 e4e5", []string{"info string e4e5 in moves within the postion commad is not a corect move"}},
-		{"ponderhit", "ponderhit", []string{"info string ponderhit not implemented"}},
-		{"debug", "debug on", []string{"info string debug not implemented"}},
-		{"go movetime", "go movetime 1000", []string{"info string go movetime not implemented"}},
-		{"go movestogo", "go movestogo 20", []string{"info string go movestogo not implemented"}},
-		{"go wtime", "go wtime 10000", []string{"info string go wtime not implemented"}},
-		{"go btime", "go btime 11000", []string{"info string go btime not implemented"}},
-		{"go winc", "go winc 500", []string{"info string go winc not implemented"}},
-		{"go binc", "go binc 500", []string{"info string go binc not implemented"}},
-		{"go depth", "go depth 7", []string{"info string go depth not implemented"}},
-		{"go nodes", "go nodes 11000", []string{"info string go nodes not implemented"}},
-		{"go mate", "go mate 11000", []string{"info string go mate not implemented"}},
-		{"go ponder", "go ponder", []string{"info string go ponder not implemented"}},
-		{"go infinte", "go infinite", []string{"info string go infinite not implemented"}},
-		{"stop", "stop", []string{"info string stop not implemented"}},
+		{"pos incorrect move 3", "position startpos moves e2e4 e7e5 e4e5", []string{"info string e4e5 in the position command is an illegal move"}},
+		{"ponderhit", "ponderhit", []string{"info string ponderhit without go ponder"}},
+		{"debug on", "debug on", []string{"info string debug is true"}},
+		{"debug off", "debug off", []string{"info string debug is false"}},
+		{"go movetime", "go movetime 100", []string{"bestmove"}},
+		{"go wtime", "go wtime 3000 btime 3000", []string{"bestmove"}},
+		{"go winc", "go wtime 3000 btime 3000 winc 100 binc 100", []string{"bestmove"}},
+		{"go movestogo", "go wtime 3000 btime 3000 movestogo 20", []string{"bestmove"}},
+		{"go depth", "go depth 3", []string{"info depth 3", "bestmove"}},
+		{"go depth not numeric", "go depth x", []string{"info string go depth x is not a valid number"}},
+		{"go nodes", "go nodes 11000", []string{"bestmove"}},
+		{"go mate", "go mate 1", []string{"bestmove"}},
+		{"go mate 0", "go mate 0", []string{"info string go mate 0 must be at least 1"}},
+		{"go infinte", "go infinite", []string{"info depth 1"}},
+		{"stop", "stop", []string{"bestmove"}},
+		{"bench", "bench 2", []string{"info string bench depth 2 positions 40 nodes"}},
+		{"bench wrong depth", "bench x", []string{"info string bench depth x is not a valid depth"}},
 		{"wrong cmd", "skit", []string{"info string unknown cmd"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			all2GUI = []string{}
+			clearGUI()
 			input <- tt.cmd
-			time.Sleep(10 * time.Millisecond)
-			for ix, want := range tt.wanted {
-				if len(all2GUI) <= ix {
-					t.Errorf("%v: we want %#v in ix=%v but got nothing", tt.name, want, ix)
-					continue
-				}
-				if len(want) > len(all2GUI[ix]) {
-					t.Errorf("%v: we want %#v (in index %v) but we got %#v", tt.name, want, ix, all2GUI[ix])
-					continue
-				}
-				if all2GUI[ix][:len(want)] != want {
-					t.Errorf("%v: Error. Should be %#v but we got %#v", tt.name, want, all2GUI[ix])
-				}
+			if want, ok := findInGUI(tt.wanted); !ok {
+				t.Errorf("%v: we want %#v but we got %#v", tt.name, want, guiLines())
 			}
-
 		})
 	}
 }
 
+// findInGUI waits (max 5 seconds) until all wanted lines (or the start of them) are sent to the GUI in the same order.
+// It returns false and the first wanted line that wasn't found if it fails
+func findInGUI(wanted []string) (string, bool) {
+	for i := 0; i < 1000; i++ {
+		ix := 0
+		for _, line := range guiLines() {
+			if ix < len(wanted) && strings.HasPrefix(line, wanted[ix]) {
+				ix++
+			}
+		}
+		if ix == len(wanted) {
+			return "", true
+		}
+		if i == 999 {
+			return wanted[ix], false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return "", true
+}
+
+// quitUci sends quit and waits until uci has left. The next test may change tell
+func quitUci(input chan string) {
+	input <- "quit"
+	findInGUI([]string{"info string leaving uci"})
+}
+
+// waitForGUI waits (max 1 second) until at least n lines are sent to the GUI
+func waitForGUI(n int) {
+	for i := 0; i < 200 && len(guiLines()) < n; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
 func Test_handlePosition(t *testing.T) {
 	type arg struct{ sq, p12 int }
 	tests := []struct {
@@ -123,4 +174,145 @@ func Test_handleNewgame(t *testing.T) {
 			t.Errorf("%v: 50 move rule should be %v but we got %v", "ucinewgame", 0, board.rule50)
 		}
 	})
-}
\ No newline at end of file
+}
+
+func Test_ponder(t *testing.T) {
+	tell = testTell
+	input := make(chan string)
+	go uci(input)
+	waitForGUI(1)
+
+	tests := []struct {
+		name   string
+		cmds   []string
+		wanted []string
+	}{
+		{"ponderhit after search", []string{"position startpos moves e2e4", "go ponder wtime 10000 btime 10000 depth 2"}, []string{"info score"}},
+		{"ponderhit", []string{"ponderhit"}, []string{"bestmove"}},
+		{"stop after search", []string{"position startpos moves e2e4", "go ponder wtime 10000 btime 10000 depth 2"}, []string{"info score"}},
+		{"stop", []string{"stop"}, []string{"bestmove"}},
+		{"ponderhit timed", []string{"position startpos moves e2e4", "go ponder wtime 1000 btime 1000", "ponderhit"}, []string{"bestmove"}},
+		{"stop while searching", []string{"position startpos moves e2e4", "go ponder wtime 10000 btime 10000", "stop"}, []string{"bestmove"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearGUI()
+			for _, cmd := range tt.cmds {
+				input <- cmd
+			}
+			if want, ok := findInGUI(tt.wanted); !ok {
+				t.Errorf("%v: we want %#v but we got %#v", tt.name, want, guiLines())
+			}
+			if tt.wanted[0] == "info score" { // no bestmove while pondering
+				time.Sleep(200 * time.Millisecond)
+				for _, line := range guiLines() {
+					if strings.HasPrefix(line, "bestmove") {
+						t.Errorf("%v: bestmove must not be sent before ponderhit or stop. We got %#v", tt.name, guiLines())
+					}
+				}
+			}
+		})
+	}
+	quitUci(input)
+}
+
+func Test_searchmoves(t *testing.T) {
+	tell = testTell
+	input := make(chan string)
+	go uci(input)
+	waitForGUI(1)
+
+	tests := []struct {
+		name   string
+		cmd    string
+		wanted []string
+	}{
+		{"one move", "go searchmoves a2a3 depth 3", []string{"bestmove a2a3"}},
+		{"two moves", "go depth 2 searchmoves h2h3 a2a3", []string{"info depth 2 currmove", "info depth 2 currmove", "bestmove"}},
+		{"illegal move", "go searchmoves e2e5 g1h3 depth 2", []string{"info string searchmoves e2e5 is not a legal move", "bestmove g1h3"}},
+		{"no legal moves", "go searchmoves e1e2 depth 1", []string{"info string searchmoves e1e2 is not a legal move", "info string no legal searchmoves", "bestmove"}},
+		{"nodes", "go searchmoves b1c3 nodes 500", []string{"bestmove b1c3"}},
+		{"movetime", "go searchmoves b2b4 movetime 100", []string{"bestmove b2b4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input <- "position startpos"
+			clearGUI()
+			input <- tt.cmd
+			if want, ok := findInGUI(tt.wanted); !ok {
+				t.Errorf("%v: we want %#v but we got %#v", tt.name, want, guiLines())
+			}
+			if tt.name == "two moves" {
+				for _, line := range guiLines() {
+					if strings.Contains(line, "currmove") && !strings.Contains(line, "h2h3") && !strings.Contains(line, "a2a3") {
+						t.Errorf("%v: only h2h3 and a2a3 should be searched but we got %#v", tt.name, line)
+					}
+				}
+			}
+		})
+	}
+	quitUci(input)
+}
+
+func Test_goMate(t *testing.T) {
+	tell = testTell
+	input := make(chan string)
+	go uci(input)
+	waitForGUI(1)
+
+	tests := []struct {
+		name  string
+		pos   string
+		mate  string
+		found bool
+	}{
+		{"mate in 1", "position fen r1bqkbnr/pppp1ppp/2n5/4p3/2B1P3/5Q2/PPPP1PPP/RNB1K1NR w KQkq - 4 4", "1", true},
+		{"mate in 2", "position fen 7k/8/8/8/8/8/R7/1R4K1 w - - 0 1", "2", true},
+		{"mate in 2 found with 3", "position fen 7k/8/8/8/8/8/R7/1R4K1 w - - 0 1", "3", true},
+		{"black mate in 2", "position fen 1r4k1/r7/8/8/8/8/8/7K b - - 0 1", "2", true},
+		{"no mate in 1", "position fen 7k/8/8/8/8/8/R7/1R4K1 w - - 0 1", "1", false},
+		{"no mate in 2", "position startpos", "2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input <- tt.pos
+			clearGUI()
+			input <- "go mate " + tt.mate
+			if want, ok := findInGUI([]string{"bestmove"}); !ok {
+				t.Fatalf("%v: we want %#v but we got %#v", tt.name, want, guiLines())
+			}
+			if !tt.found {
+				if _, ok := findInGUI([]string{"info string no mate in " + tt.mate + " found"}); !ok {
+					t.Errorf("%v: should tell that no mate is found. We got %#v", tt.name, guiLines())
+				}
+				return
+			}
+
+			// the last info line must have the mate score and the complete mating line
+			last := ""
+			for _, line := range guiLines() {
+				if strings.HasPrefix(line, "info score") {
+					last = line
+				}
+			}
+			if !strings.Contains(last, "score mate ") {
+				t.Fatalf("%v: no mate score in %#v", tt.name, last)
+			}
+			n, _ := strconv.Atoi(strings.Fields(last[strings.Index(last, "score mate ")+11:])[0])
+			if max, _ := strconv.Atoi(tt.mate); n < 1 || n > max {
+				t.Errorf("%v: should be mate in 1 to %v but we got %#v", tt.name, max, last)
+			}
+			mvs := strings.Fields(last[strings.Index(last, " pv ")+4:])
+			if len(mvs) != 2*n-1 {
+				t.Errorf("%v: the mating line should have %v moves but we got %#v", tt.name, 2*n-1, last)
+			}
+			handlePosition(tt.pos + " moves " + strings.Join(mvs, " "))
+			var ml moveList
+			board.genAllLegals(&ml)
+			if len(ml) != 0 || !board.inCheck() {
+				t.Errorf("%v: the pv %v doesn't end with mate", tt.name, mvs)
+			}
+		})
+	}
+	quitUci(input)
+}